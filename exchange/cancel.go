@@ -0,0 +1,79 @@
+package exchange
+
+import (
+	"context"
+)
+
+// OrderFilter is the filter for orders, empty field matches any
+type OrderFilter struct {
+	UserID string
+	Market string
+	Sides  []Side
+}
+
+// CancelResult is the result of cancelling an order
+type CancelResult struct {
+	OrderID string
+	Err     error
+}
+
+func (s *service) CancelAllOrders(ctx context.Context, filter OrderFilter) ([]CancelResult, error) {
+	if filter.UserID == "" && filter.Market == "" {
+		return nil, ErrInvalidFilter
+	}
+
+	return s.AdminCancelAllOrders(ctx, filter)
+}
+
+func (s *service) AdminCancelAllOrders(ctx context.Context, filter OrderFilter) ([]CancelResult, error) {
+	orders, err := s.repo.ListActiveOrders(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.cancelOrders(ctx, orders), nil
+}
+
+// cancelOrders cancels orders, an order that failed to cancel does not stop the others
+func (s *service) cancelOrders(ctx context.Context, orders []Order) []CancelResult {
+	// group orders by market to lock each order book once
+	var markets []string
+	marketOrders := make(map[string][]Order)
+	for _, order := range orders {
+		if _, ok := marketOrders[order.Market]; !ok {
+			markets = append(markets, order.Market)
+		}
+		marketOrders[order.Market] = append(marketOrders[order.Market], order)
+	}
+
+	results := make([]CancelResult, 0, len(orders))
+	for _, market := range markets {
+		results = append(results, s.cancelMarketOrders(ctx, market, marketOrders[market])...)
+	}
+
+	return results
+}
+
+func (s *service) cancelMarketOrders(ctx context.Context, market string, orders []Order) []CancelResult {
+	results := make([]CancelResult, len(orders))
+	for i, order := range orders {
+		results[i].OrderID = order.ID
+	}
+
+	err := s.execute(ctx, market, func(ctx context.Context, book *orderBook) error {
+		for i, order := range orders {
+			orderID := order.ID
+			results[i].Err = s.runInTx(ctx, book, func(ctx context.Context) error {
+				return s.cancelOrder(ctx, book, orderID)
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		for i := range results {
+			results[i].Err = err
+		}
+	}
+
+	return results
+}
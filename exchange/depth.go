@@ -0,0 +1,59 @@
+package exchange
+
+import (
+	"context"
+
+	"github.com/shopspring/decimal"
+)
+
+// Depth is market's order book aggregated by rate
+type Depth struct {
+	Bids []DepthLevel // sorted by rate descending
+	Asks []DepthLevel // sorted by rate ascending
+}
+
+// DepthLevel is total visible value at a rate,
+// iceberg orders show only their visible slices
+type DepthLevel struct {
+	Rate  decimal.Decimal
+	Value decimal.Decimal
+}
+
+func (s *service) GetDepth(ctx context.Context, market string, limit int) (Depth, error) {
+	if limit < 0 {
+		return Depth{}, ErrInvalidLimit
+	}
+	if !s.validMarket(ctx, market) {
+		return Depth{}, ErrInvalidMarket
+	}
+
+	var depth Depth
+	err := s.execute(ctx, market, func(ctx context.Context, book *orderBook) error {
+		depth.Bids = book.depth(Buy, limit)
+		depth.Asks = book.depth(Sell, limit)
+		return nil
+	})
+	if err != nil {
+		return Depth{}, err
+	}
+
+	return depth, nil
+}
+
+// depth returns side's visible levels, zero limit for all levels
+func (b *orderBook) depth(side Side, limit int) []DepthLevel {
+	levels := *b.levels(side)
+	if limit > 0 && limit < len(levels) {
+		levels = levels[:limit]
+	}
+
+	result := make([]DepthLevel, 0, len(levels))
+	for _, level := range levels {
+		var value decimal.Decimal
+		for _, order := range level.orders {
+			value = value.Add(order.display())
+		}
+		result = append(result, DepthLevel{Rate: level.rate, Value: value})
+	}
+	return result
+}
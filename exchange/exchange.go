@@ -3,6 +3,8 @@ package exchange
 import (
 	"context"
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/shopspring/decimal"
 
@@ -11,40 +13,156 @@ import (
 
 // Errors
 var (
-	ErrInvalidValue  = errors.New("exchange: invalid order value")
-	ErrInvalidSide   = errors.New("exchange: invalid order side")
-	ErrInvalidRate   = errors.New("exchange: invalid order rate")
-	ErrInvalidType   = errors.New("exchange: invalid order type")
-	ErrOrderNotFound = errors.New("exchange: order not found")
+	ErrInvalidValue               = errors.New("exchange: invalid order value")
+	ErrInvalidSide                = errors.New("exchange: invalid order side")
+	ErrInvalidRate                = errors.New("exchange: invalid order rate")
+	ErrInvalidStopRate            = errors.New("exchange: invalid order stop rate")
+	ErrInvalidType                = errors.New("exchange: invalid order type")
+	ErrInvalidMarket              = errors.New("exchange: invalid market")
+	ErrInvalidTimeInForce         = errors.New("exchange: invalid order time in force")
+	ErrInvalidExpiresAt           = errors.New("exchange: invalid order expire time")
+	ErrCannotFill                 = errors.New("exchange: order can not be filled immediately")
+	ErrWouldTake                  = errors.New("exchange: post-only order would take liquidity")
+	ErrInvalidFee                 = errors.New("exchange: invalid fee")
+	ErrInvalidSlippage            = errors.New("exchange: invalid order slippage")
+	ErrOrderNotFound              = errors.New("exchange: order not found")
+	ErrOrderNotActive             = errors.New("exchange: order is not active")
+	ErrNotOrderOwner              = errors.New("exchange: not order owner")
+	ErrInvalidLimit               = errors.New("exchange: invalid limit")
+	ErrClosed                     = errors.New("exchange: closed")
+	ErrInvalidSelfTradePrevention = errors.New("exchange: invalid self-trade prevention")
+	ErrInvalidDisplayValue        = errors.New("exchange: invalid order display value")
+	ErrInvalidTrail               = errors.New("exchange: invalid order trail")
+	ErrNoLastRate                 = errors.New("exchange: market has no last trade rate")
+	ErrOrderGrouped               = errors.New("exchange: order is in a group")
+	ErrInvalidTickSize            = errors.New("exchange: order rate is not a multiple of tick size")
+	ErrInvalidStepSize            = errors.New("exchange: order value is not a multiple of step size")
+	ErrValueTooSmall              = errors.New("exchange: order value is less than minimum value")
+	ErrValueTooLarge              = errors.New("exchange: order value is greater than maximum value")
+	ErrNotionalTooSmall           = errors.New("exchange: order notional is less than minimum notional")
+	ErrInvalidPrecision           = errors.New("exchange: order value exceeds currency precision")
+	ErrInvalidFilter              = errors.New("exchange: filter requires user or market")
 )
 
 // Exchange is exchange service
 type Exchange interface {
 	// PlaceLimitOrder places a limit order
-	PlaceLimitOrder(ctx context.Context, userID string, side Side, rate, value decimal.Decimal) (orderID string, err error)
+	PlaceLimitOrder(ctx context.Context, userID string, market string, side Side, rate, value decimal.Decimal) (orderID string, err error)
+
+	// PlaceLimitOrderWithOptions places a limit order with options
+	PlaceLimitOrderWithOptions(ctx context.Context, userID string, market string, side Side, rate, value decimal.Decimal, opts LimitOrderOptions) (orderID string, err error)
 
 	// PlaceMarketOrder places a market order
-	PlaceMarketOrder(ctx context.Context, userID string, side Side, value decimal.Decimal) (orderID string, err error)
+	PlaceMarketOrder(ctx context.Context, userID string, market string, side Side, value decimal.Decimal) (orderID string, err error)
+
+	// PlaceMarketOrderWithOptions places a market order with options
+	PlaceMarketOrderWithOptions(ctx context.Context, userID string, market string, side Side, value decimal.Decimal, opts MarketOrderOptions) (orderID string, err error)
+
+	// PreviewMarketOrder previews how a market order would fill with current order book,
+	// iceberg orders count only their visible value
+	PreviewMarketOrder(ctx context.Context, market string, side Side, value decimal.Decimal, opts MarketOrderOptions) (MarketOrderPreview, error)
+
+	// GetDepth gets market's order book depth by price level, zero limit for all levels,
+	// iceberg orders show only their visible value
+	GetDepth(ctx context.Context, market string, limit int) (Depth, error)
+
+	// PlaceStopLimitOrder places a stop-limit order,
+	// the order becomes a limit order when last trade rate crosses stop rate
+	PlaceStopLimitOrder(ctx context.Context, userID string, market string, side Side, stopRate, rate, value decimal.Decimal) (orderID string, err error)
+
+	// PlaceStopMarketOrder places a stop-market order,
+	// the order becomes a market order when last trade rate crosses stop rate
+	PlaceStopMarketOrder(ctx context.Context, userID string, market string, side Side, stopRate, value decimal.Decimal) (orderID string, err error)
+
+	// PlaceTrailingStopOrder places a trailing stop order,
+	// the stop rate follows last trade rate by trail and the order becomes a market order
+	// when last trade rate reverses to stop rate
+	PlaceTrailingStopOrder(ctx context.Context, userID string, market string, side Side, trail Trail, value decimal.Decimal) (orderID string, err error)
+
+	// PlaceOCOOrder places a limit order and a stop order in one-cancels-the-other group,
+	// the orders share reserved funds and a fill or cancel of one order cancels the other
+	PlaceOCOOrder(ctx context.Context, userID string, market string, oco OCOOrder) (limitOrderID, stopOrderID string, err error)
+
+	// ModifyOrder changes user's limit order's rate and remaining value,
+	// the order loses time priority unless only remaining value is reduced
+	ModifyOrder(ctx context.Context, userID string, orderID string, rate, remaining decimal.Decimal) error
+
+	// AdminModifyOrder changes any user's limit order's rate and remaining value
+	AdminModifyOrder(ctx context.Context, orderID string, rate, remaining decimal.Decimal) error
+
+	// CancelOrder cancels user's order
+	CancelOrder(ctx context.Context, userID string, orderID string) error
+
+	// AdminCancelOrder cancels any user's order
+	AdminCancelOrder(ctx context.Context, orderID string) error
+
+	// CancelAllOrders cancels all active orders that match filter,
+	// filter must have user or market
+	CancelAllOrders(ctx context.Context, filter OrderFilter) ([]CancelResult, error)
+
+	// AdminCancelAllOrders cancels all active orders that match filter,
+	// empty filter cancels every active order
+	AdminCancelAllOrders(ctx context.Context, filter OrderFilter) ([]CancelResult, error)
+
+	// GetOrder gets an order
+	GetOrder(ctx context.Context, orderID string) (Order, error)
+
+	// ListOpenOrders lists active orders that match filter
+	ListOpenOrders(ctx context.Context, filter OrderFilter) ([]Order, error)
+
+	// ListOrderHistory lists orders from newest to oldest,
+	// returns cursor for next page or empty string if no more order
+	ListOrderHistory(ctx context.Context, query OrderHistoryQuery) (orders []Order, nextCursor string, err error)
+
+	// ListTrades lists market's recent trades from newest to oldest
+	ListTrades(ctx context.Context, market string, limit int) ([]Trade, error)
+
+	// ListUserTrades lists user's trades from newest to oldest,
+	// returns cursor for next page or empty string if no more trade
+	ListUserTrades(ctx context.Context, query TradeHistoryQuery) (trades []Trade, nextCursor string, err error)
+
+	// CancelExpiredOrders cancels all good-till-date orders that expired at given time,
+	// an order that failed to cancel does not stop the others
+	CancelExpiredOrders(ctx context.Context, now time.Time) ([]CancelResult, error)
 
-	// CancelOrder cancels a order
-	CancelOrder(ctx context.Context, orderID string) error
+	// Close stops all market workers after pending matching finished,
+	// commands waiting in queue return ErrClosed
+	Close() error
 }
 
-// Repository is exchange storage
+// Repository is exchange storage,
+// active orders are orders that status is open (Active or PartiallyFilled),
+// dust is the value below currency's precision that rounded off from wallets
 type Repository interface {
 	CreateOrder(ctx context.Context, order Order) (orderID string, err error)
 	GetOrder(ctx context.Context, orderID string) (Order, error)
 	SetOrderStatus(ctx context.Context, orderID string, status Status) error
-	SetOrderStatusRemainingAndStampMatched(ctx context.Context, orderID string, status Status, remaining decimal.Decimal) error
+	SetOrderTypeAndRate(ctx context.Context, orderID string, typ Type, rate decimal.Decimal) error
+	SetOrderStopRate(ctx context.Context, orderID string, stopRate decimal.Decimal) error
+	SetOrderGroupID(ctx context.Context, orderID string, groupID string) error
+	SetOrderStatusRemainingFilledAndStampMatched(ctx context.Context, orderID string, status Status, remaining, filled, averageRate decimal.Decimal) error
+	SetOrderRateValueAndRemaining(ctx context.Context, orderID string, rate, value, remaining decimal.Decimal, resetPriority bool) error
 	StampOrderFinished(ctx context.Context, orderID string) error
-	GetFee(ctx context.Context, userID string, side Side, rate, amount decimal.Decimal) (decimal.Decimal, error)
-	GetActiveBuyLimitOrderHighestRate(ctx context.Context) (Order, error)
-	GetActiveSellLimitOrderLowestRate(ctx context.Context) (Order, error)
-	InsertHistory(ctx context.Context, srcOrder, dstOrder Order, side Side, rate, amount, srcFee, dstFee decimal.Decimal) error
+	GetUserFeeTier(ctx context.Context, userID string) (tier int, err error)
+	GetUserVolume(ctx context.Context, userID string, since time.Time) (decimal.Decimal, error)
+	ListActiveLimitOrders(ctx context.Context, market string) ([]Order, error)
+	ListActiveStopOrders(ctx context.Context, market string) ([]Order, error)
+	ListGroupOrders(ctx context.Context, groupID string) ([]Order, error)
+	ListActiveOrders(ctx context.Context, filter OrderFilter) ([]Order, error)
+	ListExpiredOrders(ctx context.Context, now time.Time) ([]Order, error)
+	ListOrderHistory(ctx context.Context, query OrderHistoryQuery) (orders []Order, nextCursor string, err error)
+	InsertTrade(ctx context.Context, trade Trade) (tradeID string, err error)
+	ListTrades(ctx context.Context, market string, limit int) ([]Trade, error)
+	ListUserTrades(ctx context.Context, query TradeHistoryQuery) (trades []Trade, nextCursor string, err error)
+	AddDust(ctx context.Context, currency string, value decimal.Decimal) error
 }
 
-// CurrencyGetter is the function that return currency
-type CurrencyGetter func(context.Context) string
+// CurrencyGetter is the function that return currency for a market,
+// or empty string if market is not supported
+type CurrencyGetter func(ctx context.Context, market string) string
+
+// AccountGetter is the function that return account's user id for a currency
+type AccountGetter func(ctx context.Context, currency string) string
 
 // Currency is exchange currency
 type Currency struct {
@@ -52,63 +170,221 @@ type Currency struct {
 	Sell CurrencyGetter
 }
 
-// New creates new exchange
+// LimitOrderOptions is the options for placing limit order
+type LimitOrderOptions struct {
+	TimeInForce TimeInForce
+	ExpiresAt   time.Time // required for GTD
+	PostOnly    bool      // reject order if it would match immediately
+
+	// DisplayValue is the visible value of iceberg order in the book,
+	// zero for showing the whole order
+	DisplayValue decimal.Decimal
+}
+
+// Config is exchange config
+type Config struct {
+	Repository          Repository
+	Wallet              wallet.Wallet
+	Currency            Currency
+	FeeSchedule         FeeSchedule            // nil for no fee
+	FeeAccount          AccountGetter          // nil for not collecting fee and no rebate, rebates are paid from its pre-funded balance
+	TxRunner            TxRunner               // nil for no transaction
+	QueueSize           int                    // pending commands per market before submit blocks, zero for default
+	MaxFills            int                    // fills per matching call before the rest continues asynchronously, zero for no limit
+	ErrorHandler        func(err error)        // handles asynchronous matching error, the failed order is cancelled, nil for ignore
+	SelfTradePrevention SelfTradePrevention    // zero for allow self trade
+	AccountGroup        AccountGroupGetter     // nil for preventing self trade by user id only
+	Rules               RulesGetter            // nil for no trading rules
+	Precision           wallet.PrecisionGetter // nil for no rounding
+}
+
+// MarketOrderOptions is the options for placing market order
+type MarketOrderOptions struct {
+	QuoteValue  bool            // value is in buy currency, buy side only
+	WorstRate   decimal.Decimal // stop matching at rate worse than this rate, zero for no limit
+	MaxSlippage decimal.Decimal // stop matching at rate away from best rate more than this ratio (0.05 for 5%), zero for no limit
+}
+
+// New creates new exchange,
+// caller must call Close to stop market workers
 func New(repo Repository, wallet wallet.Wallet, currency Currency) Exchange {
-	return &service{repo, wallet, currency}
+	return NewWithConfig(Config{
+		Repository: repo,
+		Wallet:     wallet,
+		Currency:   currency,
+	})
+}
+
+// NewWithConfig creates new exchange with config,
+// caller must call Close to stop market workers
+func NewWithConfig(config Config) Exchange {
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+
+	return &service{
+		repo:         config.Repository,
+		wallet:       config.Wallet,
+		currency:     config.Currency,
+		fee:          config.FeeSchedule,
+		feeAccount:   config.FeeAccount,
+		tx:           config.TxRunner,
+		queueSize:    queueSize,
+		maxFills:     config.MaxFills,
+		errHandler:   config.ErrorHandler,
+		stp:          config.SelfTradePrevention,
+		accountGroup: config.AccountGroup,
+		rules:        config.Rules,
+		precision:    config.Precision,
+		markets:      make(map[string]*marketWorker),
+		closed:       make(chan struct{}),
+	}
 }
 
 type service struct {
-	repo     Repository
-	wallet   wallet.Wallet
-	currency Currency
+	repo         Repository
+	wallet       wallet.Wallet
+	currency     Currency
+	fee          FeeSchedule
+	feeAccount   AccountGetter
+	tx           TxRunner
+	maxFills     int
+	errHandler   func(err error)
+	stp          SelfTradePrevention
+	accountGroup AccountGroupGetter
+	rules        RulesGetter
+	precision    wallet.PrecisionGetter
+
+	queueSize int
+	workersMu sync.Mutex
+	markets   map[string]*marketWorker // market => worker
+	workers   sync.WaitGroup
+	closed    chan struct{}
 }
 
-func (s *service) getCurrency(ctx context.Context, side Side) string {
+func (s *service) getCurrency(ctx context.Context, market string, side Side) string {
 	switch side {
 	case Buy:
-		return s.currency.Buy(ctx)
+		return s.currency.Buy(ctx, market)
 	case Sell:
-		return s.currency.Sell(ctx)
+		return s.currency.Sell(ctx, market)
 	default:
 		panic("unreachable")
 	}
 }
 
-func (s *service) PlaceLimitOrder(ctx context.Context, userID string, side Side, rate, value decimal.Decimal) (string, error) {
+func (s *service) validMarket(ctx context.Context, market string) bool {
+	return market != "" && s.getCurrency(ctx, market, Buy) != "" && s.getCurrency(ctx, market, Sell) != ""
+}
+
+func (s *service) PlaceLimitOrder(ctx context.Context, userID string, market string, side Side, rate, value decimal.Decimal) (string, error) {
+	return s.PlaceLimitOrderWithOptions(ctx, userID, market, side, rate, value, LimitOrderOptions{})
+}
+
+func (s *service) PlaceLimitOrderWithOptions(ctx context.Context, userID string, market string, side Side, rate, value decimal.Decimal, opts LimitOrderOptions) (string, error) {
 	if value.LessThanOrEqual(decimal.Zero) {
 		return "", ErrInvalidValue
 	}
 	if rate.LessThanOrEqual(decimal.Zero) {
 		return "", ErrInvalidRate
 	}
-
-	var err error
-	switch side {
-	case Buy:
-		err = s.wallet.Add(ctx, userID, s.getCurrency(ctx, side), value.Mul(rate).Neg())
-	case Sell:
-		err = s.wallet.Add(ctx, userID, s.getCurrency(ctx, side), value.Neg())
-	default:
+	if !ValidSide(side) {
 		return "", ErrInvalidSide
 	}
+	if !s.validMarket(ctx, market) {
+		return "", ErrInvalidMarket
+	}
+	if !ValidTimeInForce(opts.TimeInForce) {
+		return "", ErrInvalidTimeInForce
+	}
+	if opts.TimeInForce == GTD {
+		if !opts.ExpiresAt.After(time.Now()) {
+			return "", ErrInvalidExpiresAt
+		}
+	} else if !opts.ExpiresAt.IsZero() {
+		return "", ErrInvalidExpiresAt
+	}
+	if opts.PostOnly && (opts.TimeInForce == IOC || opts.TimeInForce == FOK) {
+		return "", ErrInvalidTimeInForce
+	}
+	if !opts.DisplayValue.IsZero() {
+		if opts.DisplayValue.LessThan(decimal.Zero) || opts.DisplayValue.GreaterThanOrEqual(value) {
+			return "", ErrInvalidDisplayValue
+		}
+		// iceberg order must rest in the book
+		if opts.TimeInForce == IOC || opts.TimeInForce == FOK {
+			return "", ErrInvalidTimeInForce
+		}
+	}
+	err := s.checkRules(ctx, &Order{Market: market, Side: side, Rate: rate, Value: value})
 	if err != nil {
 		return "", err
 	}
 
-	orderID, err := s.repo.CreateOrder(ctx, Order{
-		UserID:    userID,
-		Type:      Limit,
-		Side:      side,
-		Rate:      rate,
-		Value:     value,
-		Remaining: value,
-		Status:    Active,
+	var orderID string
+	err = s.execute(ctx, market, func(ctx context.Context, book *orderBook) error {
+		// fill or kill order must check liquidity before touching wallet,
+		// self-trade prevention cancels own orders and continues only in CancelOldest mode
+		if opts.TimeInForce == FOK && !book.fillable(side, rate, value, s.ownOrder(ctx, userID), s.stp == CancelOldest) {
+			return ErrCannotFill
+		}
+
+		if opts.PostOnly && book.crosses(side, rate) {
+			return ErrWouldTake
+		}
+
+		return s.runInTx(ctx, book, func(ctx context.Context) error {
+			var err error
+			orderID, err = s.placeLimitOrder(ctx, book, Order{
+				UserID:       userID,
+				Market:       market,
+				Type:         Limit,
+				Side:         side,
+				Rate:         rate,
+				Value:        value,
+				Remaining:    value,
+				Status:       Active,
+				TimeInForce:  opts.TimeInForce,
+				ExpiresAt:    opts.ExpiresAt,
+				PostOnly:     opts.PostOnly,
+				DisplayValue: opts.DisplayValue,
+			})
+			return err
+		})
 	})
 	if err != nil {
 		return "", err
 	}
 
-	err = s.matchingLimitOrder(ctx, orderID)
+	return orderID, nil
+}
+
+func (s *service) placeLimitOrder(ctx context.Context, book *orderBook, order Order) (string, error) {
+	err := s.addBalance(ctx, order.UserID, s.getCurrency(ctx, order.Market, order.Side), reservedValue(&order).Neg())
+	if err != nil {
+		return "", err
+	}
+
+	orderID, err := s.repo.CreateOrder(ctx, order)
+	if err != nil {
+		return "", err
+	}
+
+	pending, err := s.matchingLimitOrder(ctx, book, orderID)
+	if err != nil {
+		return "", err
+	}
+
+	// immediate or cancel order never rests in the book
+	if !pending && (order.TimeInForce == IOC || order.TimeInForce == FOK) {
+		err = s.cancelOrder(ctx, book, orderID)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = s.runTriggeredOrders(ctx, book)
 	if err != nil {
 		return "", err
 	}
@@ -116,32 +392,86 @@ func (s *service) PlaceLimitOrder(ctx context.Context, userID string, side Side,
 	return orderID, nil
 }
 
-func (s *service) PlaceMarketOrder(ctx context.Context, userID string, side Side, value decimal.Decimal) (string, error) {
+func (s *service) PlaceMarketOrder(ctx context.Context, userID string, market string, side Side, value decimal.Decimal) (string, error) {
+	return s.PlaceMarketOrderWithOptions(ctx, userID, market, side, value, MarketOrderOptions{})
+}
+
+func (s *service) PlaceMarketOrderWithOptions(ctx context.Context, userID string, market string, side Side, value decimal.Decimal, opts MarketOrderOptions) (string, error) {
 	if value.LessThanOrEqual(decimal.Zero) {
 		return "", ErrInvalidValue
 	}
 	if !ValidSide(side) {
 		return "", ErrInvalidSide
 	}
+	if opts.QuoteValue && side != Buy {
+		return "", ErrInvalidSide
+	}
+	if !s.validMarket(ctx, market) {
+		return "", ErrInvalidMarket
+	}
+	err := validMarketOrderOptions(opts)
+	if err != nil {
+		return "", err
+	}
+	err = s.checkRules(ctx, &Order{Market: market, Type: Market, Side: side, Value: value, QuoteValue: opts.QuoteValue})
+	if err != nil {
+		return "", err
+	}
 
-	orderID, err := s.repo.CreateOrder(ctx, Order{
-		UserID:    userID,
-		Type:      Market,
-		Side:      side,
-		Value:     value,
-		Remaining: value,
-		Status:    Active,
+	var orderID string
+	err = s.execute(ctx, market, func(ctx context.Context, book *orderBook) error {
+		order := Order{
+			UserID:     userID,
+			Market:     market,
+			Type:       Market,
+			Side:       side,
+			Value:      value,
+			Remaining:  value,
+			Status:     Active,
+			QuoteValue: opts.QuoteValue,
+			WorstRate:  book.worstRate(side, opts),
+		}
+		book.prepareMarketOrder(&order)
+		order.Rate = s.reserveRate(ctx, &order, order.Rate)
+
+		return s.runInTx(ctx, book, func(ctx context.Context) error {
+			var err error
+			orderID, err = s.placeMarketOrder(ctx, book, order)
+			return err
+		})
 	})
 	if err != nil {
 		return "", err
 	}
 
-	err = s.matchingMarketOrder(ctx, orderID)
+	return orderID, nil
+}
+
+func (s *service) placeMarketOrder(ctx context.Context, book *orderBook, order Order) (string, error) {
+	// reserve maximum spend, unspent value will refund when cancel
+	err := s.addBalance(ctx, order.UserID, s.getCurrency(ctx, order.Market, order.Side), reservedValue(&order).Neg())
+	if err != nil {
+		return "", err
+	}
+
+	orderID, err := s.repo.CreateOrder(ctx, order)
 	if err != nil {
 		return "", err
 	}
 
-	err = s.CancelOrder(ctx, orderID)
+	pending, err := s.matchingMarketOrder(ctx, book, orderID)
+	if err != nil {
+		return "", err
+	}
+
+	if !pending {
+		err = s.cancelOrder(ctx, book, orderID)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = s.runTriggeredOrders(ctx, book)
 	if err != nil {
 		return "", err
 	}
@@ -149,17 +479,52 @@ func (s *service) PlaceMarketOrder(ctx context.Context, userID string, side Side
 	return orderID, nil
 }
 
-func (s *service) CancelOrder(ctx context.Context, orderID string) error {
+func (s *service) CancelOrder(ctx context.Context, userID string, orderID string) error {
+	order, err := s.repo.GetOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+
+	if order.UserID != userID {
+		return ErrNotOrderOwner
+	}
+
+	return s.AdminCancelOrder(ctx, orderID)
+}
+
+func (s *service) AdminCancelOrder(ctx context.Context, orderID string) error {
+	order, err := s.repo.GetOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+
+	return s.execute(ctx, order.Market, func(ctx context.Context, book *orderBook) error {
+		return s.runInTx(ctx, book, func(ctx context.Context) error {
+			return s.cancelOrder(ctx, book, orderID)
+		})
+	})
+}
+
+func (s *service) cancelOrder(ctx context.Context, book *orderBook, orderID string) error {
 	order, err := s.repo.GetOrder(ctx, orderID)
 	if err != nil {
 		return err
 	}
 
-	if order.Status != Active {
+	if !order.Status.IsOpen() {
 		return nil
 	}
 
-	err = s.repo.SetOrderStatus(ctx, order.ID, Cancelled)
+	if o := book.get(order.ID); o != nil {
+		book.remove(o)
+	}
+
+	status := Cancelled
+	if order.Filled.GreaterThan(decimal.Zero) {
+		status = PartiallyCancelled
+	}
+
+	err = s.repo.SetOrderStatus(ctx, order.ID, status)
 	if err != nil {
 		return err
 	}
@@ -169,290 +534,427 @@ func (s *service) CancelOrder(ctx context.Context, orderID string) error {
 		return err
 	}
 
-	currency := s.getCurrency(ctx, order.Side)
-	switch order.Side {
-	case Buy:
-		err = s.wallet.Add(ctx, order.UserID, currency, order.Remaining.Mul(order.Rate))
-	case Sell:
-		err = s.wallet.Add(ctx, order.UserID, currency, order.Remaining)
-	default:
+	if !ValidSide(order.Side) {
 		return ErrInvalidSide
 	}
+
+	err = s.addBalance(ctx, order.UserID, s.getCurrency(ctx, order.Market, order.Side), reservedValue(&order))
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return s.cancelGroup(ctx, book, &order)
+}
+
+// reservedValue returns order's remaining funds that reserved in wallet
+func reservedValue(order *Order) decimal.Decimal {
+	if order.Side == Sell || order.QuoteValue {
+		return order.Remaining
+	}
+	if order.Type == StopMarket {
+		return order.Remaining.Mul(order.StopRate)
+	}
+	return order.Remaining.Mul(order.Rate)
 }
 
-func (s *service) matchingLimitOrder(ctx context.Context, orderID string) error {
+// matchingLimitOrder matches limit order and puts the remaining into the book,
+// returns true if matching stopped early and the order is queued to continue matching later
+func (s *service) matchingLimitOrder(ctx context.Context, book *orderBook, orderID string) (bool, error) {
 	order, err := s.repo.GetOrder(ctx, orderID)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	if order.Status != Active {
-		return nil
+	if !order.Status.IsOpen() {
+		return false, nil
 	}
 
 	if order.Remaining.LessThanOrEqual(decimal.Zero) {
-		return nil
+		return false, nil
 	}
 
-	err = s.runLimitMatching(ctx, &order)
+	more, err := s.runLimitMatching(ctx, book, &order)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	err = s.repo.SetOrderStatusRemainingAndStampMatched(ctx, order.ID, order.Status, order.Remaining)
+	err = s.repo.SetOrderStatusRemainingFilledAndStampMatched(ctx, order.ID, order.Status, order.Remaining, order.Filled, order.AverageRate)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	if order.Status == Matched {
 		err = s.repo.StampOrderFinished(ctx, order.ID)
 		if err != nil {
-			return err
+			return false, err
 		}
 	}
 
-	return nil
-}
+	if more {
+		book.queuePending(order.ID)
+		return true, nil
+	}
 
-func (s *service) runLimitMatching(ctx context.Context, order *Order) error {
-	var matchOrder Order
-	var err error
+	if order.Status.IsOpen() {
+		book.insert(&order)
+	}
 
-	switch order.Side {
-	case Buy:
-		matchOrder, err = s.repo.GetActiveSellLimitOrderLowestRate(ctx)
-		if err == ErrOrderNotFound {
-			return nil
-		}
-		if err != nil {
-			return err
+	return false, nil
+}
+
+// runLimitMatching fills order with opposite orders until no more match order,
+// returns true if stopped by fills limit or context done
+func (s *service) runLimitMatching(ctx context.Context, book *orderBook, order *Order) (bool, error) {
+	users := make(feeUsers)
+	for fills := 0; order.Status.IsOpen(); fills++ {
+		// caller gone while matching, fills already settled can not return as an error,
+		// fill or kill order must fill at once
+		if order.TimeInForce != FOK && ((s.maxFills > 0 && fills >= s.maxFills) || ctx.Err() != nil) {
+			return true, nil
 		}
 
-		if matchOrder.Rate.GreaterThan(order.Rate) {
-			// no more match order
-			return nil
+		var matchOrder *Order
+		switch order.Side {
+		case Buy:
+			matchOrder = book.front(Sell)
+			if matchOrder == nil {
+				return false, nil
+			}
+
+			if matchOrder.Rate.GreaterThan(order.Rate) {
+				// no more match order
+				return false, nil
+			}
+		case Sell:
+			matchOrder = book.front(Buy)
+			if matchOrder == nil {
+				return false, nil
+			}
+
+			if matchOrder.Rate.LessThan(order.Rate) {
+				// no more match order
+				return false, nil
+			}
+		default:
+			return false, ErrInvalidSide
 		}
-	case Sell:
-		matchOrder, err = s.repo.GetActiveBuyLimitOrderHighestRate(ctx)
-		if err == ErrOrderNotFound {
-			return nil
+
+		// expired order may not be swept yet, it must not trade
+		if matchOrder.expired(time.Now()) {
+			err := s.cancelOrder(ctx, book, matchOrder.ID)
+			if err != nil {
+				return false, err
+			}
+			continue
 		}
-		if err != nil {
-			return err
+
+		if s.stp != AllowSelfTrade && s.sameOwner(ctx, order, matchOrder) {
+			err := s.preventSelfTrade(ctx, book, order, matchOrder)
+			if err != nil {
+				return false, err
+			}
+			continue
 		}
 
-		if matchOrder.Rate.LessThan(order.Rate) {
-			// no more match order
-			return nil
+		rate := matchOrder.Rate
+		amount := decimal.Min(order.Remaining, matchOrder.display())
+		order.Remaining = order.Remaining.Sub(amount)
+
+		err := s.settle(ctx, book, users, order, matchOrder, rate, amount)
+		if err != nil {
+			return false, err
 		}
-	default:
-		return ErrInvalidSide
 	}
 
-	rate := matchOrder.Rate
-	amount := decimal.Min(order.Remaining, matchOrder.Remaining)
-
-	order.Remaining = order.Remaining.Sub(amount)
-	matchOrder.Remaining = matchOrder.Remaining.Sub(amount)
+	return false, nil
+}
 
-	if order.Remaining.LessThanOrEqual(decimal.Zero) {
-		order.Status = Matched
+// matchingMarketOrder matches market order,
+// returns true if matching stopped early and the order is queued to continue matching later
+func (s *service) matchingMarketOrder(ctx context.Context, book *orderBook, orderID string) (bool, error) {
+	order, err := s.repo.GetOrder(ctx, orderID)
+	if err != nil {
+		return false, err
 	}
 
-	if matchOrder.Remaining.LessThanOrEqual(decimal.Zero) {
-		matchOrder.Status = Matched
+	if !order.Status.IsOpen() {
+		return false, nil
+	}
 
-		err = s.repo.StampOrderFinished(ctx, matchOrder.ID)
-		if err != nil {
-			return err
-		}
+	if order.Remaining.LessThanOrEqual(decimal.Zero) {
+		return false, nil
 	}
 
-	err = s.repo.SetOrderStatusRemainingAndStampMatched(ctx, matchOrder.ID, matchOrder.Status, matchOrder.Remaining)
+	more, err := s.runMarketMatching(ctx, book, &order)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	orderFee, err := s.repo.GetFee(ctx, order.UserID, order.Side, order.Rate, amount)
+	err = s.repo.SetOrderStatusRemainingFilledAndStampMatched(ctx, order.ID, order.Status, order.Remaining, order.Filled, order.AverageRate)
 	if err != nil {
-		return err
+		return false, err
 	}
-	matchOrderFee, err := s.repo.GetFee(ctx, matchOrder.UserID, matchOrder.Side, matchOrder.Rate, amount)
-	if err != nil {
-		return err
+
+	if order.Status == Matched {
+		err = s.repo.StampOrderFinished(ctx, order.ID)
+		if err != nil {
+			return false, err
+		}
 	}
 
-	err = s.repo.InsertHistory(ctx, *order, matchOrder, order.Side, rate, amount, orderFee, matchOrderFee)
-	if err != nil {
-		return err
+	if more {
+		book.queuePending(order.ID)
+		return true, nil
 	}
 
-	if order.Side == Buy {
-		err = s.wallet.Add(ctx, order.UserID, s.getCurrency(ctx, matchOrder.Side), amount.Sub(orderFee))
-		if err != nil {
-			return err
+	return false, nil
+}
+
+// runMarketMatching fills order with opposite orders until no more match order,
+// returns true if stopped by fills limit or context done
+func (s *service) runMarketMatching(ctx context.Context, book *orderBook, order *Order) (bool, error) {
+	users := make(feeUsers)
+	for fills := 0; order.Status.IsOpen(); fills++ {
+		// caller gone while matching, fills already settled can not return as an error
+		if (s.maxFills > 0 && fills >= s.maxFills) || ctx.Err() != nil {
+			return true, nil
 		}
-		err = s.wallet.Add(ctx, matchOrder.UserID, s.getCurrency(ctx, order.Side), amount.Sub(matchOrderFee).Mul(rate))
-		if err != nil {
-			return err
+
+		var matchOrder *Order
+		switch order.Side {
+		case Buy:
+			matchOrder = book.front(Sell)
+		case Sell:
+			matchOrder = book.front(Buy)
+		default:
+			return false, ErrInvalidSide
 		}
-	} else {
-		err = s.wallet.Add(ctx, order.UserID, s.getCurrency(ctx, matchOrder.Side), amount.Sub(orderFee).Mul(rate))
-		if err != nil {
-			return err
+		if matchOrder == nil {
+			return false, nil
 		}
-		err = s.wallet.Add(ctx, matchOrder.UserID, s.getCurrency(ctx, order.Side), amount.Sub(matchOrderFee))
-		if err != nil {
-			return err
+
+		// expired order may not be swept yet, it must not trade
+		if matchOrder.expired(time.Now()) {
+			err := s.cancelOrder(ctx, book, matchOrder.ID)
+			if err != nil {
+				return false, err
+			}
+			continue
 		}
-	}
 
-	if order.Side == Buy && !order.Rate.Equal(rate) {
-		diffRate := order.Rate.Sub(rate)
-		diffAmount := amount.Mul(diffRate)
+		if !order.WorstRate.IsZero() && better(matchOrder.Side, order.WorstRate, matchOrder.Rate) {
+			// price protection, no more match order
+			return false, nil
+		}
 
-		if diffAmount.GreaterThan(decimal.Zero) {
-			err = s.wallet.Add(ctx, order.UserID, s.getCurrency(ctx, order.Side), diffAmount)
+		if order.Side == Buy && !order.QuoteValue && matchOrder.Rate.GreaterThan(order.Rate) {
+			// reserved funds can not fill at this rate
+			return false, nil
+		}
+
+		if s.stp != AllowSelfTrade && s.sameOwner(ctx, order, matchOrder) {
+			err := s.preventSelfTrade(ctx, book, order, matchOrder)
 			if err != nil {
-				return err
+				return false, err
 			}
+			continue
 		}
-	}
 
-	if order.Status == Active {
-		return s.runLimitMatching(ctx, order)
-	}
+		rate := matchOrder.Rate
+		var amount decimal.Decimal
 
-	return nil
-}
+		if order.QuoteValue {
+			// spend up to remaining value, the dust that can not buy any amount will be refunded
+			amount, _ = order.Remaining.QuoRem(rate, s.amountPrecision(ctx, order.Market))
+			amount = decimal.Min(amount, matchOrder.display())
+			if amount.LessThanOrEqual(decimal.Zero) {
+				return false, nil
+			}
 
-func (s *service) matchingMarketOrder(ctx context.Context, orderID string) error {
-	order, err := s.repo.GetOrder(ctx, orderID)
-	if err != nil {
-		return err
-	}
+			order.Remaining = order.Remaining.Sub(amount.Mul(rate))
+		} else {
+			amount = decimal.Min(order.Remaining, matchOrder.display())
+			order.Remaining = order.Remaining.Sub(amount)
+		}
 
-	if order.Status != Active {
-		return nil
+		err := s.settle(ctx, book, users, order, matchOrder, rate, amount)
+		if err != nil {
+			return false, err
+		}
 	}
 
-	if order.Remaining.LessThanOrEqual(decimal.Zero) {
-		return nil
-	}
+	return false, nil
+}
 
-	err = s.runMarketMatching(ctx, &order)
-	if err != nil {
-		return err
+// settle fills amount at rate to taker order and maker order,
+// taker's remaining must already be reduced
+func (s *service) settle(ctx context.Context, book *orderBook, users feeUsers, order, matchOrder *Order, rate, amount decimal.Decimal) error {
+	matchOrder.Remaining = matchOrder.Remaining.Sub(amount)
+	if matchOrder.isIceberg() {
+		matchOrder.visible = matchOrder.visible.Sub(amount)
 	}
+	order.fill(rate, amount)
+	matchOrder.fill(rate, amount)
 
-	err = s.repo.SetOrderStatusRemainingAndStampMatched(ctx, order.ID, order.Status, order.Remaining)
-	if err != nil {
-		return err
+	// first fill of grouped order cancels the others in its group
+	if order.Filled.Equal(amount) {
+		err := s.cancelGroup(ctx, book, order)
+		if err != nil {
+			return err
+		}
 	}
-
-	if order.Status == Matched {
-		err = s.repo.StampOrderFinished(ctx, order.ID)
+	if matchOrder.Filled.Equal(amount) {
+		err := s.cancelGroup(ctx, book, matchOrder)
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
-}
+	if order.Remaining.LessThanOrEqual(decimal.Zero) {
+		order.Status = Matched
+	}
 
-func (s *service) runMarketMatching(ctx context.Context, order *Order) error {
-	var matchOrder Order
-	var err error
+	if matchOrder.Remaining.LessThanOrEqual(decimal.Zero) {
+		matchOrder.Status = Matched
+		book.remove(matchOrder)
 
-	switch order.Side {
-	case Buy:
-		matchOrder, err = s.repo.GetActiveSellLimitOrderLowestRate(ctx)
-	case Sell:
-		matchOrder, err = s.repo.GetActiveBuyLimitOrderHighestRate(ctx)
-	default:
-		return ErrInvalidSide
-	}
-	if err == ErrOrderNotFound {
-		return nil
+		err := s.repo.StampOrderFinished(ctx, matchOrder.ID)
+		if err != nil {
+			return err
+		}
 	}
+
+	err := s.repo.SetOrderStatusRemainingFilledAndStampMatched(ctx, matchOrder.ID, matchOrder.Status, matchOrder.Remaining, matchOrder.Filled, matchOrder.AverageRate)
 	if err != nil {
 		return err
 	}
 
-	rate := matchOrder.Rate
-	amount := decimal.Min(order.Remaining, matchOrder.Remaining)
-
-	order.Remaining = order.Remaining.Sub(amount)
-	matchOrder.Remaining = matchOrder.Remaining.Sub(amount)
-
-	if order.Remaining.LessThanOrEqual(decimal.Zero) {
-		order.Status = Matched
-	}
-
-	if matchOrder.Remaining.LessThanOrEqual(decimal.Zero) {
-		matchOrder.Status = Matched
+	// iceberg order refreshes visible slice from hidden reserve,
+	// the new slice loses time priority
+	if matchOrder.isIceberg() && matchOrder.Status.IsOpen() && matchOrder.visible.LessThanOrEqual(decimal.Zero) {
+		book.remove(matchOrder)
+		book.insert(matchOrder)
 
-		err = s.repo.StampOrderFinished(ctx, matchOrder.ID)
+		err = s.repo.SetOrderRateValueAndRemaining(ctx, matchOrder.ID, matchOrder.Rate, matchOrder.Value, matchOrder.Remaining, true)
 		if err != nil {
 			return err
 		}
 	}
 
-	err = s.repo.SetOrderStatusRemainingAndStampMatched(ctx, matchOrder.ID, matchOrder.Status, matchOrder.Remaining)
+	orderFee, err := s.getFee(ctx, users, order, Taker, rate, amount)
+	if err != nil {
+		return err
+	}
+	matchOrderFee, err := s.getFee(ctx, users, matchOrder, Maker, rate, amount)
 	if err != nil {
 		return err
 	}
 
-	orderFee, err := s.repo.GetFee(ctx, order.UserID, order.Side, order.Rate, amount)
+	orderFee, err = s.payableFee(ctx, order, s.chargedFee(ctx, order, rate, orderFee))
+	if err != nil {
+		return err
+	}
+	matchOrderFee, err = s.payableFee(ctx, matchOrder, s.chargedFee(ctx, matchOrder, rate, matchOrderFee))
 	if err != nil {
 		return err
 	}
-	matchOrderFee, err := s.repo.GetFee(ctx, matchOrder.UserID, matchOrder.Side, matchOrder.Rate, amount)
+
+	err = s.insertTrade(ctx, book, order, matchOrder, rate, amount, orderFee, matchOrderFee)
 	if err != nil {
 		return err
 	}
 
-	err = s.repo.InsertHistory(ctx, *order, matchOrder, order.Side, rate, amount, orderFee, matchOrderFee)
+	err = s.collectFee(ctx, order, orderFee)
+	if err != nil {
+		return err
+	}
+	err = s.collectFee(ctx, matchOrder, matchOrderFee)
 	if err != nil {
 		return err
 	}
 
 	if order.Side == Buy {
-		err = s.wallet.Add(ctx, order.UserID, s.getCurrency(ctx, matchOrder.Side), amount.Sub(orderFee))
+		err = s.addBalance(ctx, order.UserID, s.getCurrency(ctx, order.Market, matchOrder.Side), amount.Sub(orderFee))
 		if err != nil {
 			return err
 		}
-		err = s.wallet.Add(ctx, order.UserID, s.getCurrency(ctx, order.Side), amount.Mul(rate).Neg())
+		err = s.addBalance(ctx, matchOrder.UserID, s.getCurrency(ctx, order.Market, order.Side), amount.Mul(rate).Sub(matchOrderFee))
 		if err != nil {
 			return err
 		}
-		err = s.wallet.Add(ctx, matchOrder.UserID, s.getCurrency(ctx, order.Side), amount.Sub(matchOrderFee).Mul(rate))
+	} else {
+		err = s.addBalance(ctx, order.UserID, s.getCurrency(ctx, order.Market, matchOrder.Side), amount.Mul(rate).Sub(orderFee))
 		if err != nil {
 			return err
 		}
-	} else {
-		err = s.wallet.Add(ctx, order.UserID, s.getCurrency(ctx, matchOrder.Side), amount.Sub(orderFee).Mul(rate))
+		err = s.addBalance(ctx, matchOrder.UserID, s.getCurrency(ctx, order.Market, order.Side), amount.Sub(matchOrderFee))
 		if err != nil {
 			return err
 		}
-		err = s.wallet.Add(ctx, order.UserID, s.getCurrency(ctx, order.Side), amount.Neg())
+	}
+
+	// buyer reserved at own rate, refund the better rate difference
+	if order.Side == Buy && !order.QuoteValue && !order.Rate.Equal(rate) {
+		diffRate := order.Rate.Sub(rate)
+		diffAmount := amount.Mul(diffRate)
+
+		if diffAmount.GreaterThan(decimal.Zero) {
+			err = s.addBalance(ctx, order.UserID, s.getCurrency(ctx, order.Market, order.Side), diffAmount)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// continueMatching continues matching order that reached fills limit,
+// then cancels the remaining if the order can not rest in the book
+func (s *service) continueMatching(ctx context.Context, book *orderBook, orderID string) error {
+	order, err := s.repo.GetOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+
+	if !order.Status.IsOpen() {
+		return nil
+	}
+
+	// rebuilt book loads the order as resting order
+	if o := book.get(orderID); o != nil {
+		book.remove(o)
+	}
+
+	var pending bool
+	switch order.Type {
+	case Limit:
+		pending, err = s.matchingLimitOrder(ctx, book, orderID)
 		if err != nil {
 			return err
 		}
-		err = s.wallet.Add(ctx, matchOrder.UserID, s.getCurrency(ctx, order.Side), amount.Sub(matchOrderFee))
+
+		if !pending && (order.TimeInForce == IOC || order.TimeInForce == FOK) {
+			err = s.cancelOrder(ctx, book, orderID)
+			if err != nil {
+				return err
+			}
+		}
+	case Market:
+		pending, err = s.matchingMarketOrder(ctx, book, orderID)
 		if err != nil {
 			return err
 		}
-	}
 
-	if order.Status == Active {
-		return s.runMarketMatching(ctx, order)
+		if !pending {
+			err = s.cancelOrder(ctx, book, orderID)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return ErrInvalidType
 	}
 
-	return nil
+	return s.runTriggeredOrders(ctx, book)
 }
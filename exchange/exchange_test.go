@@ -2,6 +2,8 @@ package exchange_test
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"testing"
 	"time"
 
@@ -18,7 +20,11 @@ func genID() string {
 }
 
 type memoryExchangeRepository struct {
-	data []exchange.Order
+	data   []exchange.Order
+	trades []exchange.Trade
+	dust   map[string]decimal.Decimal // currency => value
+
+	volumeLoads int // GetUserVolume calls
 }
 
 func (r *memoryExchangeRepository) CreateOrder(ctx context.Context, order exchange.Order) (orderID string, err error) {
@@ -47,11 +53,44 @@ func (r *memoryExchangeRepository) SetOrderStatus(ctx context.Context, orderID s
 	return nil
 }
 
-func (r *memoryExchangeRepository) SetOrderStatusRemainingAndStampMatched(ctx context.Context, orderID string, status exchange.Status, remaining decimal.Decimal) error {
+func (r *memoryExchangeRepository) SetOrderTypeAndRate(ctx context.Context, orderID string, typ exchange.Type, rate decimal.Decimal) error {
+	for i, order := range r.data {
+		if order.ID == orderID {
+			r.data[i].Type = typ
+			r.data[i].Rate = rate
+			return nil
+		}
+	}
+	return nil
+}
+
+func (r *memoryExchangeRepository) SetOrderStopRate(ctx context.Context, orderID string, stopRate decimal.Decimal) error {
+	for i, order := range r.data {
+		if order.ID == orderID {
+			r.data[i].StopRate = stopRate
+			return nil
+		}
+	}
+	return nil
+}
+
+func (r *memoryExchangeRepository) SetOrderGroupID(ctx context.Context, orderID string, groupID string) error {
+	for i, order := range r.data {
+		if order.ID == orderID {
+			r.data[i].GroupID = groupID
+			return nil
+		}
+	}
+	return nil
+}
+
+func (r *memoryExchangeRepository) SetOrderStatusRemainingFilledAndStampMatched(ctx context.Context, orderID string, status exchange.Status, remaining, filled, averageRate decimal.Decimal) error {
 	for i, order := range r.data {
 		if order.ID == orderID {
 			r.data[i].Status = status
 			r.data[i].Remaining = remaining
+			r.data[i].Filled = filled
+			r.data[i].AverageRate = averageRate
 			r.data[i].MatchedAt = time.Now()
 			return nil
 		}
@@ -59,6 +98,22 @@ func (r *memoryExchangeRepository) SetOrderStatusRemainingAndStampMatched(ctx co
 	return nil
 }
 
+func (r *memoryExchangeRepository) SetOrderRateValueAndRemaining(ctx context.Context, orderID string, rate, value, remaining decimal.Decimal, resetPriority bool) error {
+	for i, order := range r.data {
+		if order.ID == orderID {
+			order.Rate = rate
+			order.Value = value
+			order.Remaining = remaining
+			r.data[i] = order
+			if resetPriority {
+				r.data = append(append(r.data[:i], r.data[i+1:]...), order)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
 func (r *memoryExchangeRepository) StampOrderFinished(ctx context.Context, orderID string) error {
 	for i, order := range r.data {
 		if order.ID == orderID {
@@ -69,52 +124,159 @@ func (r *memoryExchangeRepository) StampOrderFinished(ctx context.Context, order
 	return nil
 }
 
-func (r *memoryExchangeRepository) GetFee(ctx context.Context, userID string, side exchange.Side, rate, amount decimal.Decimal) (decimal.Decimal, error) {
-	return amount.Mul(d("0.0025")), nil
+func (r *memoryExchangeRepository) GetUserFeeTier(ctx context.Context, userID string) (int, error) {
+	return 0, nil
+}
+
+func (r *memoryExchangeRepository) GetUserVolume(ctx context.Context, userID string, since time.Time) (decimal.Decimal, error) {
+	r.volumeLoads++
+	return decimal.Zero, nil
 }
 
-func (r *memoryExchangeRepository) GetActiveBuyLimitOrderHighestRate(ctx context.Context) (result exchange.Order, err error) {
+func (r *memoryExchangeRepository) ListActiveLimitOrders(ctx context.Context, market string) ([]exchange.Order, error) {
+	var result []exchange.Order
 	for _, order := range r.data {
-		if order.Side == exchange.Buy && order.Status == exchange.Active && order.Type == exchange.Limit {
-			if result.Rate.Equal(decimal.Zero) {
-				result = order
-			} else if order.Rate.Equal(result.Rate) {
-				if order.CreatedAt.Before(result.CreatedAt) {
-					result = order
-				}
-			} else if order.Rate.GreaterThan(result.Rate) {
-				result = order
-			}
+		if order.Market == market && order.Status.IsOpen() && order.Type == exchange.Limit {
+			result = append(result, order)
 		}
 	}
-	if result.CreatedAt.IsZero() {
-		err = exchange.ErrOrderNotFound
+	return result, nil
+}
+
+func (r *memoryExchangeRepository) ListActiveStopOrders(ctx context.Context, market string) ([]exchange.Order, error) {
+	var result []exchange.Order
+	for _, order := range r.data {
+		if order.Market == market && order.Status.IsOpen() && order.Type.IsStop() {
+			result = append(result, order)
+		}
 	}
-	return
+	return result, nil
 }
 
-func (r *memoryExchangeRepository) GetActiveSellLimitOrderLowestRate(ctx context.Context) (result exchange.Order, err error) {
+func (r *memoryExchangeRepository) ListGroupOrders(ctx context.Context, groupID string) ([]exchange.Order, error) {
+	var result []exchange.Order
 	for _, order := range r.data {
-		if order.Side == exchange.Sell && order.Status == exchange.Active && order.Type == exchange.Limit {
-			if result.Rate.Equal(decimal.Zero) {
-				result = order
-			} else if order.Rate.Equal(result.Rate) {
-				if order.CreatedAt.Before(result.CreatedAt) {
-					result = order
-				}
-			} else if order.Rate.LessThan(result.Rate) {
-				result = order
+		if order.GroupID == groupID {
+			result = append(result, order)
+		}
+	}
+	return result, nil
+}
+
+func (r *memoryExchangeRepository) AddDust(ctx context.Context, currency string, value decimal.Decimal) error {
+	if r.dust == nil {
+		r.dust = make(map[string]decimal.Decimal)
+	}
+	r.dust[currency] = r.dust[currency].Add(value)
+	return nil
+}
+
+func (r *memoryExchangeRepository) ListActiveOrders(ctx context.Context, filter exchange.OrderFilter) ([]exchange.Order, error) {
+	var result []exchange.Order
+	for _, order := range r.data {
+		if !order.Status.IsOpen() {
+			continue
+		}
+		if filter.UserID != "" && order.UserID != filter.UserID {
+			continue
+		}
+		if filter.Market != "" && order.Market != filter.Market {
+			continue
+		}
+		if len(filter.Sides) > 0 {
+			ok := false
+			for _, side := range filter.Sides {
+				ok = ok || order.Side == side
+			}
+			if !ok {
+				continue
 			}
 		}
+		result = append(result, order)
 	}
-	if result.CreatedAt.IsZero() {
-		err = exchange.ErrOrderNotFound
+	return result, nil
+}
+
+func (r *memoryExchangeRepository) ListExpiredOrders(ctx context.Context, now time.Time) ([]exchange.Order, error) {
+	var result []exchange.Order
+	for _, order := range r.data {
+		if order.Status.IsOpen() && order.TimeInForce == exchange.GTD && !order.ExpiresAt.After(now) {
+			result = append(result, order)
+		}
 	}
-	return
+	return result, nil
 }
 
-func (r *memoryExchangeRepository) InsertHistory(ctx context.Context, srcOrder, dstOrder exchange.Order, side exchange.Side, rate, amount, srcFee, dstFee decimal.Decimal) error {
-	return nil
+func (r *memoryExchangeRepository) ListOrderHistory(ctx context.Context, query exchange.OrderHistoryQuery) ([]exchange.Order, string, error) {
+	var result []exchange.Order
+	skip := query.Cursor != ""
+	for i := len(r.data) - 1; i >= 0; i-- {
+		order := r.data[i]
+		if skip {
+			skip = order.ID != query.Cursor
+			continue
+		}
+		if query.UserID != "" && order.UserID != query.UserID {
+			continue
+		}
+		if query.Market != "" && order.Market != query.Market {
+			continue
+		}
+		if len(query.Statuses) > 0 {
+			ok := false
+			for _, status := range query.Statuses {
+				ok = ok || order.Status == status
+			}
+			if !ok {
+				continue
+			}
+		}
+		if len(result) == query.Limit {
+			return result, result[len(result)-1].ID, nil
+		}
+		result = append(result, order)
+	}
+	return result, "", nil
+}
+
+func (r *memoryExchangeRepository) InsertTrade(ctx context.Context, trade exchange.Trade) (string, error) {
+	trade.ID = genID()
+	trade.CreatedAt = time.Now()
+	r.trades = append(r.trades, trade)
+	return trade.ID, nil
+}
+
+func (r *memoryExchangeRepository) ListTrades(ctx context.Context, market string, limit int) ([]exchange.Trade, error) {
+	var result []exchange.Trade
+	for i := len(r.trades) - 1; i >= 0 && len(result) < limit; i-- {
+		if r.trades[i].Market == market {
+			result = append(result, r.trades[i])
+		}
+	}
+	return result, nil
+}
+
+func (r *memoryExchangeRepository) ListUserTrades(ctx context.Context, query exchange.TradeHistoryQuery) ([]exchange.Trade, string, error) {
+	var result []exchange.Trade
+	skip := query.Cursor != ""
+	for i := len(r.trades) - 1; i >= 0; i-- {
+		trade := r.trades[i]
+		if skip {
+			skip = trade.ID != query.Cursor
+			continue
+		}
+		if trade.MakerUserID != query.UserID && trade.TakerUserID != query.UserID {
+			continue
+		}
+		if query.Market != "" && trade.Market != query.Market {
+			continue
+		}
+		if len(result) == query.Limit {
+			return result, result[len(result)-1].ID, nil
+		}
+		result = append(result, trade)
+	}
+	return result, "", nil
 }
 
 type memoryWalletRepository struct {
@@ -146,17 +308,39 @@ func (r *memoryWalletRepository) InsertTx(ctx context.Context, userID string, cu
 	return nil
 }
 
+// market => [buy currency, sell currency]
+var markets = map[string][2]string{
+	"B/A": {"A", "B"},
+	"C/A": {"A", "C"},
+}
+
 var currency = exchange.Currency{
-	Buy: func(context.Context) string {
-		return "A"
+	Buy: func(ctx context.Context, market string) string {
+		return markets[market][0]
 	},
-	Sell: func(context.Context) string {
-		return "B"
+	Sell: func(ctx context.Context, market string) string {
+		return markets[market][1]
 	},
 }
 
+const market = "B/A"
+
 var ctx = context.Background()
 
+var fee = exchange.FeeRate{
+	Maker: d("0.0025"),
+	Taker: d("0.0025"),
+}
+
+func newExchange(r exchange.Repository, w wallet.Wallet) exchange.Exchange {
+	return exchange.NewWithConfig(exchange.Config{
+		Repository:  r,
+		Wallet:      w,
+		Currency:    currency,
+		FeeSchedule: fee,
+	})
+}
+
 func d(s string) decimal.Decimal {
 	d, _ := decimal.NewFromString(s)
 	return d
@@ -190,16 +374,22 @@ func status(t *testing.T, r exchange.Repository, orderID string, s exchange.Stat
 func placeLimit(t *testing.T, s exchange.Exchange, userID string, side exchange.Side, rate, amount string) string {
 	t.Helper()
 
-	orderID, err := s.PlaceLimitOrder(ctx, userID, side, d(rate), d(amount))
+	return placeLimitMarket(t, s, userID, market, side, rate, amount)
+}
+
+func placeLimitMarket(t *testing.T, s exchange.Exchange, userID string, market string, side exchange.Side, rate, amount string) string {
+	t.Helper()
+
+	orderID, err := s.PlaceLimitOrder(ctx, userID, market, side, d(rate), d(amount))
 	assert.NoError(t, err)
 	assert.NotEmpty(t, orderID)
 	return orderID
 }
 
-func cancel(t *testing.T, s exchange.Exchange, orderID string) {
+func cancel(t *testing.T, s exchange.Exchange, userID string, orderID string) {
 	t.Helper()
 
-	err := s.CancelOrder(ctx, orderID)
+	err := s.CancelOrder(ctx, userID, orderID)
 	assert.NoError(t, err)
 }
 
@@ -208,7 +398,8 @@ func TestExchangeBuy1(t *testing.T) {
 
 	r := new(memoryExchangeRepository)
 	w := wallet.New(new(memoryWalletRepository))
-	s := exchange.New(r, w, currency)
+	s := newExchange(r, w)
+	defer s.Close()
 
 	add(t, w, "1", "A", "10000")
 	add(t, w, "2", "B", "10000")
@@ -237,7 +428,8 @@ func TestExchangeBuy2(t *testing.T) {
 
 	r := new(memoryExchangeRepository)
 	w := wallet.New(new(memoryWalletRepository))
-	s := exchange.New(r, w, currency)
+	s := newExchange(r, w)
+	defer s.Close()
 
 	add(t, w, "1", "A", "10000")
 	add(t, w, "2", "B", "10000")
@@ -250,7 +442,7 @@ func TestExchangeBuy2(t *testing.T) {
 	order2 := placeLimit(t, s, "1", exchange.Buy, "2", "60")
 
 	remain(t, r, order1, "40")
-	status(t, r, order1, exchange.Active)
+	status(t, r, order1, exchange.PartiallyFilled)
 
 	remain(t, r, order2, "0")
 	status(t, r, order2, exchange.Matched)
@@ -269,23 +461,23 @@ func TestExchangeBuy2(t *testing.T) {
 	status(t, r, order2, exchange.Matched)
 
 	remain(t, r, order3, "20")
-	status(t, r, order3, exchange.Active)
+	status(t, r, order3, exchange.PartiallyFilled)
 
 	bal(t, w, "1", "A", "9760")
 	bal(t, w, "1", "B", "99.75")
 	bal(t, w, "2", "A", "199.5")
 	bal(t, w, "2", "B", "9900")
 
-	cancel(t, s, order3)
+	cancel(t, s, "1", order3)
 	remain(t, r, order3, "20")
-	status(t, r, order3, exchange.Cancelled)
+	status(t, r, order3, exchange.PartiallyCancelled)
 
 	bal(t, w, "1", "A", "9800")
 	bal(t, w, "1", "B", "99.75")
 	bal(t, w, "2", "A", "199.5")
 	bal(t, w, "2", "B", "9900")
 
-	cancel(t, s, order2)
+	cancel(t, s, "1", order2)
 	remain(t, r, order2, "0")
 	status(t, r, order2, exchange.Matched)
 
@@ -300,7 +492,8 @@ func TestExchangeSell1(t *testing.T) {
 
 	r := new(memoryExchangeRepository)
 	w := wallet.New(new(memoryWalletRepository))
-	s := exchange.New(r, w, currency)
+	s := newExchange(r, w)
+	defer s.Close()
 
 	add(t, w, "1", "A", "10000")
 	add(t, w, "2", "B", "10000")
@@ -323,3 +516,1888 @@ func TestExchangeSell1(t *testing.T) {
 	bal(t, w, "2", "A", "99.75")
 	bal(t, w, "2", "B", "9950")
 }
+
+func TestExchangeMultiMarket(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+	add(t, w, "2", "B", "10000")
+	add(t, w, "2", "C", "10000")
+
+	order1 := placeLimitMarket(t, s, "2", "C/A", exchange.Sell, "2", "50")
+	order2 := placeLimitMarket(t, s, "1", "B/A", exchange.Buy, "2", "50")
+
+	// orders in different markets must not match
+	remain(t, r, order1, "50")
+	status(t, r, order1, exchange.Active)
+	remain(t, r, order2, "50")
+	status(t, r, order2, exchange.Active)
+
+	order3 := placeLimitMarket(t, s, "2", "B/A", exchange.Sell, "2", "50")
+
+	remain(t, r, order2, "0")
+	status(t, r, order2, exchange.Matched)
+	remain(t, r, order3, "0")
+	status(t, r, order3, exchange.Matched)
+
+	bal(t, w, "1", "A", "9900")
+	bal(t, w, "1", "B", "49.875")
+	bal(t, w, "1", "C", "0")
+	bal(t, w, "2", "A", "99.75")
+	bal(t, w, "2", "B", "9950")
+	bal(t, w, "2", "C", "9950")
+
+	_, err := s.PlaceLimitOrder(ctx, "1", "X/A", exchange.Buy, d("2"), d("50"))
+	assert.Equal(t, exchange.ErrInvalidMarket, err)
+}
+
+func TestExchangeStopLimit(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+	add(t, w, "2", "B", "10000")
+	add(t, w, "3", "B", "10000")
+
+	order1, err := s.PlaceStopLimitOrder(ctx, "3", market, exchange.Sell, d("2"), d("1.5"), d("50"))
+	assert.NoError(t, err)
+
+	bal(t, w, "3", "B", "9950")
+
+	placeLimit(t, s, "1", exchange.Buy, "1.5", "100")
+	placeLimit(t, s, "2", exchange.Sell, "2.5", "10")
+	placeLimit(t, s, "1", exchange.Buy, "2.5", "10")
+
+	// last rate 2.5 does not trigger sell stop at 2
+	remain(t, r, order1, "50")
+	status(t, r, order1, exchange.Active)
+	order, _ := r.GetOrder(ctx, order1)
+	assert.Equal(t, exchange.StopLimit, order.Type)
+
+	placeLimit(t, s, "2", exchange.Sell, "2", "10")
+	placeLimit(t, s, "1", exchange.Buy, "2", "10")
+
+	// last rate 2 triggers sell stop, then matches with buy order at 1.5
+	order, _ = r.GetOrder(ctx, order1)
+	assert.Equal(t, exchange.Limit, order.Type)
+	remain(t, r, order1, "0")
+	status(t, r, order1, exchange.Matched)
+
+	bal(t, w, "3", "A", "74.8125")
+	bal(t, w, "3", "B", "9950")
+
+	order2, err := s.PlaceStopLimitOrder(ctx, "3", market, exchange.Sell, d("1"), d("1"), d("10"))
+	assert.NoError(t, err)
+	bal(t, w, "3", "B", "9940")
+
+	assert.Equal(t, exchange.ErrNotOrderOwner, s.CancelOrder(ctx, "1", order2))
+	status(t, r, order2, exchange.Active)
+
+	cancel(t, s, "3", order2)
+	status(t, r, order2, exchange.Cancelled)
+	bal(t, w, "3", "B", "9950")
+}
+
+func TestExchangeStopMarket(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+	add(t, w, "2", "B", "10000")
+	add(t, w, "3", "A", "10000")
+
+	order1, err := s.PlaceStopMarketOrder(ctx, "3", market, exchange.Buy, d("3"), d("20"))
+	assert.NoError(t, err)
+
+	bal(t, w, "3", "A", "9940")
+
+	placeLimit(t, s, "2", exchange.Sell, "3", "10")
+	placeLimit(t, s, "2", exchange.Sell, "4", "50")
+	placeLimit(t, s, "1", exchange.Buy, "3", "10")
+
+	// last rate 3 triggers buy stop, then matches with sell order at 4
+	order, _ := r.GetOrder(ctx, order1)
+	assert.Equal(t, exchange.Market, order.Type)
+	remain(t, r, order1, "0")
+	status(t, r, order1, exchange.Matched)
+
+	bal(t, w, "3", "A", "9920")
+	bal(t, w, "3", "B", "19.95")
+}
+
+func TestExchangeTrailingStop(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := exchange.New(r, w, currency)
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+	add(t, w, "2", "B", "10000")
+	add(t, w, "3", "B", "10")
+
+	trade := func(rate string) {
+		placeLimit(t, s, "2", exchange.Sell, rate, "1")
+		placeLimit(t, s, "1", exchange.Buy, rate, "1")
+	}
+
+	_, err := s.PlaceTrailingStopOrder(ctx, "3", market, exchange.Sell, exchange.Trail{Offset: d("1"), Ratio: d("0.1")}, d("10"))
+	assert.Equal(t, exchange.ErrInvalidTrail, err)
+	_, err = s.PlaceTrailingStopOrder(ctx, "3", market, exchange.Sell, exchange.Trail{Ratio: d("1")}, d("10"))
+	assert.Equal(t, exchange.ErrInvalidTrail, err)
+	_, err = s.PlaceTrailingStopOrder(ctx, "3", market, exchange.Sell, exchange.Trail{Offset: d("1")}, d("10"))
+	assert.Equal(t, exchange.ErrNoLastRate, err)
+
+	trade("10")
+
+	// sell stop rate must be above zero
+	_, err = s.PlaceTrailingStopOrder(ctx, "3", market, exchange.Sell, exchange.Trail{Offset: d("10")}, d("10"))
+	assert.Equal(t, exchange.ErrInvalidTrail, err)
+	bal(t, w, "3", "B", "10")
+
+	order1, err := s.PlaceTrailingStopOrder(ctx, "3", market, exchange.Sell, exchange.Trail{Offset: d("1")}, d("10"))
+	assert.NoError(t, err)
+	bal(t, w, "3", "B", "0")
+
+	order, _ := s.GetOrder(ctx, order1)
+	assert.Equal(t, d("9").String(), order.StopRate.String())
+
+	// stop rate follows rising rate
+	trade("12")
+	order, _ = s.GetOrder(ctx, order1)
+	assert.Equal(t, d("11").String(), order.StopRate.String())
+
+	// but not falling rate
+	placeLimit(t, s, "1", exchange.Buy, "10.5", "20")
+	trade("11.5")
+	order, _ = s.GetOrder(ctx, order1)
+	assert.Equal(t, d("11").String(), order.StopRate.String())
+	assert.Equal(t, exchange.TrailingStop, order.Type)
+
+	// rate reverses by offset, the order becomes market order
+	trade("11")
+	order, _ = s.GetOrder(ctx, order1)
+	assert.Equal(t, exchange.Market, order.Type)
+	remain(t, r, order1, "0")
+	status(t, r, order1, exchange.Matched)
+	bal(t, w, "3", "A", "105")
+}
+
+func TestExchangeOCOOrder(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := exchange.New(r, w, currency)
+	defer s.Close()
+
+	add(t, w, "1", "B", "10")
+	add(t, w, "2", "A", "1000")
+	add(t, w, "2", "B", "1000")
+	add(t, w, "3", "A", "1000")
+
+	_, _, err := s.PlaceOCOOrder(ctx, "1", market, exchange.OCOOrder{Side: exchange.Sell, Rate: d("8"), StopRate: d("12"), Value: d("10")})
+	assert.Equal(t, exchange.ErrInvalidStopRate, err)
+
+	// fill of limit order cancels stop order
+	order1, order2, err := s.PlaceOCOOrder(ctx, "1", market, exchange.OCOOrder{Side: exchange.Sell, Rate: d("12"), StopRate: d("8"), Value: d("10")})
+	assert.NoError(t, err)
+	bal(t, w, "1", "B", "0")
+
+	err = s.ModifyOrder(ctx, "1", order1, d("13"), d("10"))
+	assert.Equal(t, exchange.ErrOrderGrouped, err)
+
+	placeLimit(t, s, "2", exchange.Buy, "12", "4")
+	remain(t, r, order1, "6")
+	status(t, r, order1, exchange.PartiallyFilled)
+	status(t, r, order2, exchange.Cancelled)
+	bal(t, w, "1", "A", "48")
+	bal(t, w, "1", "B", "0")
+
+	// settled group does not prevent modify
+	assert.NoError(t, s.ModifyOrder(ctx, "1", order1, d("12"), d("5")))
+	remain(t, r, order1, "5")
+	bal(t, w, "1", "B", "1")
+
+	cancel(t, s, "1", order1)
+	bal(t, w, "1", "B", "6")
+
+	// cancel of one order cancels the other, group refunds the larger reservation
+	order3, order4, err := s.PlaceOCOOrder(ctx, "3", market, exchange.OCOOrder{Side: exchange.Buy, Rate: d("8"), StopRate: d("12"), StopLimitRate: d("13"), Value: d("10")})
+	assert.NoError(t, err)
+	bal(t, w, "3", "A", "870")
+
+	cancel(t, s, "3", order4)
+	status(t, r, order3, exchange.Cancelled)
+	status(t, r, order4, exchange.Cancelled)
+	bal(t, w, "3", "A", "1000")
+
+	// triggered stop order cancels limit order
+	order5, order6, err := s.PlaceOCOOrder(ctx, "3", market, exchange.OCOOrder{Side: exchange.Buy, Rate: d("8"), StopRate: d("12"), Value: d("10")})
+	assert.NoError(t, err)
+	bal(t, w, "3", "A", "880")
+
+	placeLimit(t, s, "2", exchange.Sell, "12.5", "10")
+	placeLimit(t, s, "2", exchange.Sell, "12", "1")
+	placeLimit(t, s, "2", exchange.Buy, "12", "1")
+
+	status(t, r, order5, exchange.Cancelled)
+	order, _ := s.GetOrder(ctx, order6)
+	assert.Equal(t, exchange.Market, order.Type)
+	status(t, r, order6, exchange.Matched)
+	bal(t, w, "3", "A", "875")
+	bal(t, w, "3", "B", "10")
+}
+
+func TestExchangeMarketRules(t *testing.T) {
+	t.Parallel()
+
+	rules := exchange.MarketRules{
+		TickSize:    d("0.01"),
+		StepSize:    d("0.001"),
+		MinValue:    d("0.01"),
+		MaxValue:    d("100"),
+		MinNotional: d("10"),
+	}
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := exchange.NewWithConfig(exchange.Config{
+		Repository: r,
+		Wallet:     w,
+		Currency:   currency,
+		Rules: func(ctx context.Context, market string) exchange.MarketRules {
+			return rules
+		},
+	})
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+
+	place := func(rate, value string) error {
+		_, err := s.PlaceLimitOrder(ctx, "1", market, exchange.Buy, d(rate), d(value))
+		return err
+	}
+
+	assert.Equal(t, exchange.ErrInvalidTickSize, place("10.001", "5"))
+	assert.Equal(t, exchange.ErrInvalidStepSize, place("10", "5.0001"))
+	assert.Equal(t, exchange.ErrValueTooSmall, place("10000", "0.001"))
+	assert.Equal(t, exchange.ErrValueTooLarge, place("10", "100.001"))
+	assert.Equal(t, exchange.ErrNotionalTooSmall, place("10", "0.999"))
+	assert.NoError(t, place("10", "1"))
+
+	_, err := s.PlaceStopMarketOrder(ctx, "1", market, exchange.Buy, d("9.999"), d("5"))
+	assert.Equal(t, exchange.ErrInvalidTickSize, err)
+	_, err = s.PlaceMarketOrderWithOptions(ctx, "1", market, exchange.Buy, d("9"), exchange.MarketOrderOptions{QuoteValue: true})
+	assert.Equal(t, exchange.ErrNotionalTooSmall, err)
+
+	// rules change at runtime
+	rules.TickSize = d("1")
+	assert.Equal(t, exchange.ErrInvalidTickSize, place("10.5", "1"))
+}
+
+func TestExchangePrecision(t *testing.T) {
+	t.Parallel()
+
+	precision := func(ctx context.Context, currency string) int32 {
+		if currency == "A" {
+			return 2
+		}
+		return 4
+	}
+
+	r := new(memoryExchangeRepository)
+	w := wallet.NewWithPrecision(new(memoryWalletRepository), precision)
+	s := exchange.NewWithConfig(exchange.Config{
+		Repository:  r,
+		Wallet:      w,
+		Currency:    currency,
+		FeeSchedule: fee,
+		FeeAccount: func(ctx context.Context, currency string) string {
+			return "fee"
+		},
+		Precision: precision,
+	})
+	defer s.Close()
+
+	add(t, w, "1", "A", "10")
+	add(t, w, "2", "B", "10")
+
+	err := w.Add(ctx, "1", "A", d("0.001"))
+	assert.Equal(t, wallet.ErrInvalidPrecision, err)
+
+	_, err = s.PlaceLimitOrder(ctx, "2", market, exchange.Sell, d("3.333"), d("1.00001"))
+	assert.Equal(t, exchange.ErrInvalidPrecision, err)
+
+	order1 := placeLimit(t, s, "2", exchange.Sell, "3.333", "1.5")
+
+	// reservation 4.9995 exceeds A precision
+	_, err = s.PlaceLimitOrder(ctx, "1", market, exchange.Buy, d("3.333"), d("1.5"))
+	assert.Equal(t, exchange.ErrInvalidPrecision, err)
+
+	// unfilled order refunds exactly what reserved
+	order2 := placeLimit(t, s, "1", exchange.Buy, "3.33", "1")
+	bal(t, w, "1", "A", "6.67")
+	cancel(t, s, "1", order2)
+	bal(t, w, "1", "A", "10")
+
+	// better rate difference 0.0105 refunds 0.01
+	order3 := placeLimit(t, s, "1", exchange.Buy, "3.34", "1.5")
+	status(t, r, order1, exchange.Matched)
+	status(t, r, order3, exchange.Matched)
+
+	// fees round up, credits round down
+	bal(t, w, "1", "A", "5")
+	bal(t, w, "1", "B", "1.4962")
+	bal(t, w, "2", "A", "4.97")
+	bal(t, w, "2", "B", "8.5")
+	bal(t, w, "fee", "A", "0.02")
+	bal(t, w, "fee", "B", "0.0038")
+	assert.Equal(t, d("0.01").String(), r.dust["A"].String())
+	assert.True(t, r.dust["B"].IsZero())
+
+	// trade records charged fees that credited to fee account
+	trades, err := s.ListTrades(ctx, market, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, trades, 1) {
+		assert.Equal(t, d("0.02").String(), trades[0].MakerFee.String())
+		assert.Equal(t, "A", trades[0].MakerFeeCurrency)
+		assert.Equal(t, d("0.0038").String(), trades[0].TakerFee.String())
+		assert.Equal(t, "B", trades[0].TakerFeeCurrency)
+	}
+}
+
+func TestExchangeTimeInForce(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+	add(t, w, "2", "B", "10000")
+
+	placeLimit(t, s, "2", exchange.Sell, "2", "30")
+	placeLimit(t, s, "2", exchange.Sell, "3", "30")
+
+	// fill or kill
+	_, err := s.PlaceLimitOrderWithOptions(ctx, "1", market, exchange.Buy, d("2"), d("40"), exchange.LimitOrderOptions{
+		TimeInForce: exchange.FOK,
+	})
+	assert.Equal(t, exchange.ErrCannotFill, err)
+	bal(t, w, "1", "A", "10000")
+
+	order1, err := s.PlaceLimitOrderWithOptions(ctx, "1", market, exchange.Buy, d("3"), d("40"), exchange.LimitOrderOptions{
+		TimeInForce: exchange.FOK,
+	})
+	assert.NoError(t, err)
+	remain(t, r, order1, "0")
+	status(t, r, order1, exchange.Matched)
+	bal(t, w, "1", "A", "9910")
+
+	// immediate or cancel
+	order2, err := s.PlaceLimitOrderWithOptions(ctx, "1", market, exchange.Buy, d("3"), d("30"), exchange.LimitOrderOptions{
+		TimeInForce: exchange.IOC,
+	})
+	assert.NoError(t, err)
+	remain(t, r, order2, "10")
+	status(t, r, order2, exchange.PartiallyCancelled)
+	bal(t, w, "1", "A", "9850")
+
+	// good till date
+	_, err = s.PlaceLimitOrderWithOptions(ctx, "1", market, exchange.Buy, d("1"), d("10"), exchange.LimitOrderOptions{
+		TimeInForce: exchange.GTD,
+	})
+	assert.Equal(t, exchange.ErrInvalidExpiresAt, err)
+
+	expiresAt := time.Now().Add(time.Hour)
+	order3, err := s.PlaceLimitOrderWithOptions(ctx, "1", market, exchange.Buy, d("1"), d("10"), exchange.LimitOrderOptions{
+		TimeInForce: exchange.GTD,
+		ExpiresAt:   expiresAt,
+	})
+	assert.NoError(t, err)
+	bal(t, w, "1", "A", "9840")
+
+	results, err := s.CancelExpiredOrders(ctx, time.Now())
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+	status(t, r, order3, exchange.Active)
+
+	results, err = s.CancelExpiredOrders(ctx, expiresAt)
+	assert.NoError(t, err)
+	assert.Equal(t, []exchange.CancelResult{{OrderID: order3}}, results)
+	status(t, r, order3, exchange.Cancelled)
+	bal(t, w, "1", "A", "9850")
+
+	// expired order that not swept yet can not trade
+	order4, err := s.PlaceLimitOrderWithOptions(ctx, "1", market, exchange.Buy, d("1"), d("10"), exchange.LimitOrderOptions{
+		TimeInForce: exchange.GTD,
+		ExpiresAt:   time.Now().Add(20 * time.Millisecond),
+	})
+	assert.NoError(t, err)
+	bal(t, w, "1", "A", "9840")
+	time.Sleep(30 * time.Millisecond)
+
+	order5 := placeLimit(t, s, "2", exchange.Sell, "1", "10")
+	status(t, r, order4, exchange.Cancelled)
+	remain(t, r, order5, "10")
+	status(t, r, order5, exchange.Active)
+	bal(t, w, "1", "A", "9850")
+	assert.Len(t, r.trades, 3)
+}
+
+// failingExchangeRepository fails to set status of an order
+type failingExchangeRepository struct {
+	*memoryExchangeRepository
+	orderID string
+	err     error
+}
+
+func (r *failingExchangeRepository) SetOrderStatus(ctx context.Context, orderID string, status exchange.Status) error {
+	if orderID == r.orderID {
+		return r.err
+	}
+	return r.memoryExchangeRepository.SetOrderStatus(ctx, orderID, status)
+}
+
+func TestExchangeExpirySweeper(t *testing.T) {
+	t.Parallel()
+
+	errStatus := errors.New("status error")
+	r := &failingExchangeRepository{memoryExchangeRepository: new(memoryExchangeRepository), err: errStatus}
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "100")
+
+	opts := exchange.LimitOrderOptions{
+		TimeInForce: exchange.GTD,
+		ExpiresAt:   time.Now().Add(10 * time.Millisecond),
+	}
+	order1, err := s.PlaceLimitOrderWithOptions(ctx, "1", market, exchange.Buy, d("1"), d("10"), opts)
+	assert.NoError(t, err)
+	order2, err := s.PlaceLimitOrderWithOptions(ctx, "1", market, exchange.Buy, d("1"), d("10"), opts)
+	assert.NoError(t, err)
+	r.orderID = order1
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error)
+	done := make(chan error, 1)
+	go func() {
+		done <- exchange.RunExpirySweeper(ctx, s, 10*time.Millisecond, func(err error) {
+			select {
+			case errs <- err:
+			case <-ctx.Done():
+			}
+		})
+	}()
+
+	// failed order does not stop the others or the sweeper
+	assert.Equal(t, errStatus, <-errs)
+	assert.Equal(t, errStatus, <-errs)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+
+	status(t, r, order1, exchange.Active)
+	status(t, r, order2, exchange.Cancelled)
+	bal(t, w, "1", "A", "90")
+}
+
+func TestExchangePostOnly(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+	add(t, w, "2", "B", "10000")
+
+	order1 := placeLimit(t, s, "2", exchange.Sell, "2", "30")
+
+	_, err := s.PlaceLimitOrderWithOptions(ctx, "1", market, exchange.Buy, d("2"), d("10"), exchange.LimitOrderOptions{
+		PostOnly: true,
+	})
+	assert.Equal(t, exchange.ErrWouldTake, err)
+	remain(t, r, order1, "30")
+	bal(t, w, "1", "A", "10000")
+
+	order2, err := s.PlaceLimitOrderWithOptions(ctx, "1", market, exchange.Buy, d("1.9"), d("10"), exchange.LimitOrderOptions{
+		PostOnly: true,
+	})
+	assert.NoError(t, err)
+	remain(t, r, order2, "10")
+	status(t, r, order2, exchange.Active)
+	bal(t, w, "1", "A", "9981")
+}
+
+func TestExchangeMakerTakerFee(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := exchange.NewWithConfig(exchange.Config{
+		Repository: r,
+		Wallet:     w,
+		Currency:   currency,
+		FeeSchedule: exchange.FeeScheduleFunc(func(ctx context.Context, req exchange.FeeRequest) (decimal.Decimal, error) {
+			assert.Equal(t, market, req.Market)
+			if req.Liquidity == exchange.Maker {
+				// maker rebate
+				return req.Amount.Mul(d("-0.001")), nil
+			}
+			return req.Amount.Mul(d("0.003")), nil
+		}),
+		FeeAccount: func(ctx context.Context, currency string) string {
+			return "fee-" + currency
+		},
+	})
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+	add(t, w, "2", "B", "10000")
+	add(t, w, "fee-A", "A", "1")
+
+	placeLimit(t, s, "2", exchange.Sell, "2", "100")
+	placeLimit(t, s, "1", exchange.Buy, "2", "100")
+
+	bal(t, w, "1", "A", "9800")
+	bal(t, w, "1", "B", "99.7")
+	bal(t, w, "2", "A", "200.2")
+	bal(t, w, "2", "B", "9900")
+	bal(t, w, "fee-A", "A", "0.8")
+	bal(t, w, "fee-B", "B", "0.3")
+
+	// no fee account to pay rebate
+	r = new(memoryExchangeRepository)
+	w = wallet.New(new(memoryWalletRepository))
+	s = exchange.NewWithConfig(exchange.Config{
+		Repository:  r,
+		Wallet:      w,
+		Currency:    currency,
+		FeeSchedule: exchange.FeeRate{Maker: d("-0.01")},
+	})
+	defer s.Close()
+
+	add(t, w, "1", "A", "100")
+	add(t, w, "2", "B", "100")
+
+	placeLimit(t, s, "2", exchange.Sell, "2", "10")
+	placeLimit(t, s, "1", exchange.Buy, "2", "10")
+
+	// total supply is conserved
+	bal(t, w, "1", "A", "80")
+	bal(t, w, "1", "B", "10")
+	bal(t, w, "2", "A", "20")
+	bal(t, w, "2", "B", "90")
+}
+
+type userStatsFeeSchedule struct {
+	exchange.FeeScheduleFunc
+	needsUserStats bool
+}
+
+func (f userStatsFeeSchedule) NeedsUserStats() bool {
+	return f.needsUserStats
+}
+
+func TestExchangeFeeUserLoad(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := exchange.NewWithConfig(exchange.Config{
+		Repository: r,
+		Wallet:     w,
+		Currency:   currency,
+		FeeSchedule: exchange.FeeScheduleFunc(func(ctx context.Context, req exchange.FeeRequest) (decimal.Decimal, error) {
+			return fee.Fee(ctx, req)
+		}),
+	})
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+	add(t, w, "2", "B", "10000")
+	add(t, w, "3", "B", "10000")
+
+	placeLimit(t, s, "2", exchange.Sell, "2", "10")
+	placeLimit(t, s, "2", exchange.Sell, "2", "10")
+	placeLimit(t, s, "3", exchange.Sell, "2", "10")
+
+	// each user loads once per matching call
+	placeLimit(t, s, "1", exchange.Buy, "2", "30")
+	assert.Equal(t, 3, r.volumeLoads)
+
+	// flat fee rate does not load user
+	r = new(memoryExchangeRepository)
+	s = newExchange(r, w)
+	defer s.Close()
+
+	placeLimit(t, s, "2", exchange.Sell, "2", "10")
+	placeLimit(t, s, "1", exchange.Buy, "2", "10")
+	assert.Equal(t, 0, r.volumeLoads)
+	assert.Len(t, r.trades, 1)
+
+	// fee schedule can opt out of loading user
+	r = new(memoryExchangeRepository)
+	s = exchange.NewWithConfig(exchange.Config{
+		Repository: r,
+		Wallet:     w,
+		Currency:   currency,
+		FeeSchedule: userStatsFeeSchedule{
+			FeeScheduleFunc: func(ctx context.Context, req exchange.FeeRequest) (decimal.Decimal, error) {
+				return fee.Fee(ctx, req)
+			},
+		},
+	})
+	defer s.Close()
+
+	placeLimit(t, s, "2", exchange.Sell, "2", "10")
+	placeLimit(t, s, "1", exchange.Buy, "2", "10")
+	assert.Equal(t, 0, r.volumeLoads)
+	assert.Len(t, r.trades, 1)
+}
+
+func TestExchangeFeeAccount(t *testing.T) {
+	t.Parallel()
+
+	newFeeExchange := func(r exchange.Repository, w wallet.Wallet) exchange.Exchange {
+		return exchange.NewWithConfig(exchange.Config{
+			Repository: r,
+			Wallet:     w,
+			Currency:   currency,
+			FeeSchedule: exchange.FeeRate{
+				Maker: d("-0.001"),
+				Taker: d("0.003"),
+			},
+			FeeAccount: func(ctx context.Context, currency string) string {
+				return "fee-" + currency
+			},
+		})
+	}
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newFeeExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+	add(t, w, "2", "B", "10000")
+	add(t, w, "fee-A", "A", "1")
+
+	placeLimit(t, s, "2", exchange.Sell, "2", "100")
+	placeLimit(t, s, "1", exchange.Buy, "2", "60")
+
+	bal(t, w, "1", "A", "9880")
+	bal(t, w, "1", "B", "59.82")
+	bal(t, w, "2", "A", "120.12")
+	bal(t, w, "2", "B", "9900")
+	bal(t, w, "fee-A", "A", "0.88")
+	bal(t, w, "fee-B", "B", "0.18")
+
+	// total supply is conserved, 40 B is reserved in the order book
+	// A: 9880 + 120.12 + 0.88 = 10001
+	// B: 59.82 + 9900 + 0.18 + 40 = 10000
+
+	// fee account can not pay rebate, the maker gets no rebate
+	r = new(memoryExchangeRepository)
+	w = wallet.New(new(memoryWalletRepository))
+	s = newFeeExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+	add(t, w, "2", "B", "10000")
+
+	placeLimit(t, s, "2", exchange.Sell, "2", "100")
+	placeLimit(t, s, "1", exchange.Buy, "2", "60")
+
+	bal(t, w, "1", "A", "9880")
+	bal(t, w, "1", "B", "59.82")
+	bal(t, w, "2", "A", "120")
+	bal(t, w, "fee-A", "A", "0")
+	bal(t, w, "fee-B", "B", "0.18")
+
+	trades, err := s.ListTrades(ctx, market, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, trades, 1) {
+		assert.True(t, trades[0].MakerFee.IsZero())
+		assert.Equal(t, d("0.18").String(), trades[0].TakerFee.String())
+	}
+}
+
+func TestExchangeMarketBuyQuoteValue(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+	add(t, w, "2", "B", "10000")
+
+	order1 := placeLimit(t, s, "2", exchange.Sell, "3", "10")
+	order2 := placeLimit(t, s, "2", exchange.Sell, "4", "10")
+
+	opts := exchange.MarketOrderOptions{QuoteValue: true}
+
+	_, err := s.PlaceMarketOrderWithOptions(ctx, "1", market, exchange.Sell, d("50"), opts)
+	assert.Equal(t, exchange.ErrInvalidSide, err)
+
+	order3, err := s.PlaceMarketOrderWithOptions(ctx, "1", market, exchange.Buy, d("50"), opts)
+	assert.NoError(t, err)
+
+	status(t, r, order1, exchange.Matched)
+	remain(t, r, order2, "5")
+	remain(t, r, order3, "0")
+	status(t, r, order3, exchange.Matched)
+
+	bal(t, w, "1", "A", "9950")
+	bal(t, w, "1", "B", "14.9625")
+	bal(t, w, "2", "A", "49.875")
+
+	// spend all at last level, refund dust
+	order4, err := s.PlaceMarketOrderWithOptions(ctx, "1", market, exchange.Buy, d("10"), opts)
+	assert.NoError(t, err)
+
+	remain(t, r, order2, "2.5")
+	remain(t, r, order4, "0")
+	status(t, r, order4, exchange.Matched)
+
+	bal(t, w, "1", "A", "9940")
+	bal(t, w, "1", "B", "17.45625")
+
+	order5 := placeLimit(t, s, "2", exchange.Sell, "3", "10")
+
+	order6, err := s.PlaceMarketOrderWithOptions(ctx, "1", market, exchange.Buy, d("10"), opts)
+	assert.NoError(t, err)
+
+	remain(t, r, order5, "6.66666667")
+	remain(t, r, order6, "0.00000001")
+	status(t, r, order6, exchange.PartiallyCancelled)
+	remain(t, r, order2, "2.5")
+
+	bal(t, w, "1", "A", "9930.00000001")
+}
+
+func TestExchangeMarketOrderSlippage(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+	add(t, w, "2", "B", "10000")
+
+	placeLimit(t, s, "2", exchange.Sell, "2", "10")
+	placeLimit(t, s, "2", exchange.Sell, "2.1", "10")
+	order1 := placeLimit(t, s, "2", exchange.Sell, "3", "10")
+
+	opts := exchange.MarketOrderOptions{MaxSlippage: d("0.1")}
+
+	p, err := s.PreviewMarketOrder(ctx, market, exchange.Buy, d("30"), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, "2", p.BestRate.String())
+	assert.Equal(t, "2.1", p.WorstRate.String())
+	assert.Equal(t, "2.05", p.AverageRate.String())
+	assert.Equal(t, "20", p.Amount.String())
+	assert.Equal(t, "41", p.Total.String())
+	assert.Equal(t, "10", p.Remaining.String())
+
+	// tighter worst rate wins
+	p, err = s.PreviewMarketOrder(ctx, market, exchange.Buy, d("30"), exchange.MarketOrderOptions{
+		WorstRate:   d("2"),
+		MaxSlippage: d("0.1"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "10", p.Amount.String())
+
+	order2, err := s.PlaceMarketOrderWithOptions(ctx, "1", market, exchange.Buy, d("30"), opts)
+	assert.NoError(t, err)
+
+	remain(t, r, order1, "10")
+	status(t, r, order1, exchange.Active)
+	remain(t, r, order2, "10")
+	status(t, r, order2, exchange.PartiallyCancelled)
+
+	bal(t, w, "1", "A", "9959")
+	bal(t, w, "1", "B", "19.95")
+
+	_, err = s.PlaceMarketOrderWithOptions(ctx, "1", market, exchange.Buy, d("30"), exchange.MarketOrderOptions{MaxSlippage: d("-1")})
+	assert.Equal(t, exchange.ErrInvalidSlippage, err)
+}
+
+func TestExchangeMarketOrderReserve(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "30")
+	add(t, w, "2", "B", "10000")
+
+	order1 := placeLimit(t, s, "2", exchange.Sell, "2", "10")
+	order2 := placeLimit(t, s, "2", exchange.Sell, "3", "10")
+
+	// reserve 15 * 3 but has only 30
+	_, err := s.PlaceMarketOrder(ctx, "1", market, exchange.Buy, d("15"))
+	assert.Equal(t, wallet.ErrBalanceNotEnough, err)
+	remain(t, r, order1, "10")
+	remain(t, r, order2, "10")
+	bal(t, w, "1", "A", "30")
+
+	add(t, w, "1", "A", "15")
+
+	order3, err := s.PlaceMarketOrder(ctx, "1", market, exchange.Buy, d("15"))
+	assert.NoError(t, err)
+	remain(t, r, order1, "0")
+	remain(t, r, order2, "5")
+	remain(t, r, order3, "0")
+	status(t, r, order3, exchange.Matched)
+
+	bal(t, w, "1", "A", "10")
+	bal(t, w, "1", "B", "14.9625")
+
+	// unfilled market sell must not create funds
+	order4, err := s.PlaceMarketOrder(ctx, "2", market, exchange.Sell, d("10"))
+	assert.NoError(t, err)
+	remain(t, r, order4, "10")
+	status(t, r, order4, exchange.Cancelled)
+	bal(t, w, "2", "B", "9980")
+}
+
+func TestExchangeModifyOrder(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+	add(t, w, "2", "B", "10000")
+	add(t, w, "3", "B", "10000")
+
+	order1 := placeLimit(t, s, "2", exchange.Sell, "2", "10")
+	order2 := placeLimit(t, s, "3", exchange.Sell, "2", "10")
+
+	// size reduction keeps time priority
+	assert.NoError(t, s.ModifyOrder(ctx, "2", order1, d("2"), d("5")))
+	remain(t, r, order1, "5")
+	bal(t, w, "2", "B", "9995")
+
+	placeLimit(t, s, "1", exchange.Buy, "2", "2")
+	remain(t, r, order1, "3")
+	remain(t, r, order2, "10")
+
+	// size increase loses time priority
+	assert.NoError(t, s.ModifyOrder(ctx, "2", order1, d("2"), d("8")))
+	remain(t, r, order1, "8")
+	bal(t, w, "2", "B", "9990")
+
+	placeLimit(t, s, "1", exchange.Buy, "2", "10")
+	remain(t, r, order1, "8")
+	remain(t, r, order2, "0")
+
+	// price change that crosses the book re-runs matching
+	order3 := placeLimit(t, s, "1", exchange.Buy, "1.8", "5")
+	assert.NoError(t, s.ModifyOrder(ctx, "2", order1, d("1.8"), d("8")))
+	remain(t, r, order1, "3")
+	status(t, r, order1, exchange.PartiallyFilled)
+	remain(t, r, order3, "0")
+	status(t, r, order3, exchange.Matched)
+
+	// buy order reservation follows rate
+	order4 := placeLimit(t, s, "1", exchange.Buy, "1", "10")
+	bal(t, w, "1", "A", "9957")
+	assert.NoError(t, s.ModifyOrder(ctx, "1", order4, d("1.5"), d("10")))
+	bal(t, w, "1", "A", "9952")
+
+	assert.Equal(t, wallet.ErrBalanceNotEnough, s.ModifyOrder(ctx, "1", order4, d("1.5"), d("100000")))
+	remain(t, r, order4, "10")
+
+	// only owner can modify the order
+	assert.Equal(t, exchange.ErrNotOrderOwner, s.ModifyOrder(ctx, "2", order4, d("1"), d("10")))
+	assert.NoError(t, s.AdminModifyOrder(ctx, order4, d("1"), d("10")))
+	bal(t, w, "1", "A", "9957")
+
+	assert.NoError(t, s.AdminCancelOrder(ctx, order4))
+	assert.Equal(t, exchange.ErrOrderNotActive, s.ModifyOrder(ctx, "1", order4, d("1"), d("10")))
+}
+
+func TestExchangeCancelAllOrders(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+	add(t, w, "1", "B", "10000")
+	add(t, w, "1", "C", "10000")
+	add(t, w, "2", "A", "10000")
+
+	order1 := placeLimitMarket(t, s, "1", "B/A", exchange.Buy, "1", "10")
+	order2 := placeLimitMarket(t, s, "1", "B/A", exchange.Sell, "2", "10")
+	order3 := placeLimitMarket(t, s, "1", "C/A", exchange.Sell, "2", "10")
+	order4 := placeLimitMarket(t, s, "2", "B/A", exchange.Buy, "1", "10")
+	order5, err := s.PlaceStopLimitOrder(ctx, "1", "C/A", exchange.Buy, d("3"), d("3"), d("10"))
+	assert.NoError(t, err)
+
+	results, err := s.CancelAllOrders(ctx, exchange.OrderFilter{UserID: "1", Sides: []exchange.Side{exchange.Sell}})
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+	for _, result := range results {
+		assert.NoError(t, result.Err)
+	}
+	status(t, r, order1, exchange.Active)
+	status(t, r, order2, exchange.Cancelled)
+	status(t, r, order3, exchange.Cancelled)
+
+	results, err = s.CancelAllOrders(ctx, exchange.OrderFilter{Market: "B/A"})
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+	status(t, r, order1, exchange.Cancelled)
+	status(t, r, order4, exchange.Cancelled)
+	status(t, r, order5, exchange.Active)
+
+	_, err = s.CancelAllOrders(ctx, exchange.OrderFilter{Sides: []exchange.Side{exchange.Buy}})
+	assert.Equal(t, exchange.ErrInvalidFilter, err)
+	status(t, r, order5, exchange.Active)
+
+	results, err = s.AdminCancelAllOrders(ctx, exchange.OrderFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, []exchange.CancelResult{{OrderID: order5}}, results)
+	status(t, r, order5, exchange.Cancelled)
+
+	bal(t, w, "1", "A", "10000")
+	bal(t, w, "1", "B", "10000")
+	bal(t, w, "1", "C", "10000")
+	bal(t, w, "2", "A", "10000")
+}
+
+func TestExchangeQueryOrders(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+	add(t, w, "2", "B", "10000")
+
+	order1 := placeLimit(t, s, "1", exchange.Buy, "1", "10")
+	order2 := placeLimit(t, s, "1", exchange.Buy, "2", "10")
+	order3 := placeLimit(t, s, "2", exchange.Sell, "2", "10")
+	order4 := placeLimit(t, s, "1", exchange.Buy, "1.5", "10")
+	cancel(t, s, "1", order1)
+
+	order, err := s.GetOrder(ctx, order2)
+	assert.NoError(t, err)
+	assert.Equal(t, exchange.Matched, order.Status)
+
+	_, err = s.GetOrder(ctx, "invalid")
+	assert.Equal(t, exchange.ErrOrderNotFound, err)
+
+	orders, err := s.ListOpenOrders(ctx, exchange.OrderFilter{UserID: "1", Market: market})
+	assert.NoError(t, err)
+	if assert.Len(t, orders, 1) {
+		assert.Equal(t, order4, orders[0].ID)
+	}
+
+	orders, cursor, err := s.ListOrderHistory(ctx, exchange.OrderHistoryQuery{UserID: "1", Limit: 2})
+	assert.NoError(t, err)
+	if assert.Len(t, orders, 2) {
+		assert.Equal(t, order4, orders[0].ID)
+		assert.Equal(t, order2, orders[1].ID)
+	}
+	assert.NotEmpty(t, cursor)
+
+	orders, cursor, err = s.ListOrderHistory(ctx, exchange.OrderHistoryQuery{UserID: "1", Limit: 2, Cursor: cursor})
+	assert.NoError(t, err)
+	if assert.Len(t, orders, 1) {
+		assert.Equal(t, order1, orders[0].ID)
+	}
+	assert.Empty(t, cursor)
+
+	orders, _, err = s.ListOrderHistory(ctx, exchange.OrderHistoryQuery{
+		Statuses: []exchange.Status{exchange.Matched},
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, orders, 2) {
+		assert.Equal(t, order3, orders[0].ID)
+		assert.Equal(t, order2, orders[1].ID)
+	}
+
+	_, _, err = s.ListOrderHistory(ctx, exchange.OrderHistoryQuery{Limit: -1})
+	assert.Equal(t, exchange.ErrInvalidLimit, err)
+}
+
+func TestExchangeTrades(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+	add(t, w, "2", "B", "10000")
+	add(t, w, "3", "B", "10000")
+
+	order1 := placeLimit(t, s, "2", exchange.Sell, "2", "10")
+	order2 := placeLimit(t, s, "3", exchange.Sell, "3", "10")
+	order3 := placeLimit(t, s, "1", exchange.Buy, "3", "15")
+
+	trades, err := s.ListTrades(ctx, market, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, trades, 2) {
+		assert.Equal(t, exchange.Trade{
+			ID:               trades[0].ID,
+			Market:           market,
+			MakerOrderID:     order2,
+			MakerUserID:      "3",
+			TakerOrderID:     order3,
+			TakerUserID:      "1",
+			TakerSide:        exchange.Buy,
+			Rate:             d("3"),
+			Amount:           d("5"),
+			MakerFee:         d("0.0375"),
+			MakerFeeCurrency: "A",
+			TakerFee:         d("0.0125"),
+			TakerFeeCurrency: "B",
+			CreatedAt:        trades[0].CreatedAt,
+		}, trades[0])
+		assert.Equal(t, order1, trades[1].MakerOrderID)
+		assert.Equal(t, "10", trades[1].Amount.String())
+	}
+
+	trades, err = s.ListTrades(ctx, "C/A", 0)
+	assert.NoError(t, err)
+	assert.Empty(t, trades)
+
+	trades, cursor, err := s.ListUserTrades(ctx, exchange.TradeHistoryQuery{UserID: "1", Limit: 1})
+	assert.NoError(t, err)
+	if assert.Len(t, trades, 1) {
+		assert.Equal(t, order2, trades[0].MakerOrderID)
+	}
+
+	trades, cursor, err = s.ListUserTrades(ctx, exchange.TradeHistoryQuery{UserID: "1", Limit: 1, Cursor: cursor})
+	assert.NoError(t, err)
+	if assert.Len(t, trades, 1) {
+		assert.Equal(t, order1, trades[0].MakerOrderID)
+	}
+	assert.Empty(t, cursor)
+
+	trades, _, err = s.ListUserTrades(ctx, exchange.TradeHistoryQuery{UserID: "2"})
+	assert.NoError(t, err)
+	assert.Len(t, trades, 1)
+}
+
+func TestExchangeOrderFill(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+	add(t, w, "2", "B", "10000")
+
+	order1 := placeLimit(t, s, "2", exchange.Sell, "2", "10")
+	order2 := placeLimit(t, s, "2", exchange.Sell, "3", "30")
+	order3 := placeLimit(t, s, "1", exchange.Buy, "3", "20")
+	order4 := placeLimit(t, s, "1", exchange.Buy, "1", "20")
+
+	order, _ := r.GetOrder(ctx, order3)
+	assert.Equal(t, exchange.Matched, order.Status)
+	assert.Equal(t, "20", order.Filled.String())
+	assert.Equal(t, "2.5", order.AverageRate.String())
+
+	order, _ = r.GetOrder(ctx, order1)
+	assert.Equal(t, exchange.Matched, order.Status)
+	assert.Equal(t, "10", order.Filled.String())
+	assert.Equal(t, "2", order.AverageRate.String())
+
+	order, _ = r.GetOrder(ctx, order2)
+	assert.Equal(t, exchange.PartiallyFilled, order.Status)
+	assert.Equal(t, "10", order.Filled.String())
+	assert.Equal(t, "3", order.AverageRate.String())
+
+	cancel(t, s, "2", order2)
+	status(t, r, order2, exchange.PartiallyCancelled)
+
+	cancel(t, s, "1", order4)
+	status(t, r, order4, exchange.Cancelled)
+}
+
+func TestExchangeRebuildOrderBook(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "10000")
+	add(t, w, "2", "B", "10000")
+
+	order1 := placeLimit(t, s, "2", exchange.Sell, "3", "50")
+	order2 := placeLimit(t, s, "2", exchange.Sell, "2", "20")
+	order3 := placeLimit(t, s, "2", exchange.Sell, "2", "30")
+
+	// new exchange instance must rebuild order book from repository
+	s = newExchange(r, w)
+	defer s.Close()
+
+	order4 := placeLimit(t, s, "1", exchange.Buy, "3", "60")
+
+	remain(t, r, order2, "0")
+	status(t, r, order2, exchange.Matched)
+	remain(t, r, order3, "0")
+	status(t, r, order3, exchange.Matched)
+	remain(t, r, order1, "40")
+	status(t, r, order1, exchange.PartiallyFilled)
+	remain(t, r, order4, "0")
+	status(t, r, order4, exchange.Matched)
+
+	bal(t, w, "1", "A", "9870")
+	bal(t, w, "1", "B", "59.85")
+	bal(t, w, "2", "A", "129.675")
+}
+
+func TestExchangeRebuildPendingOrders(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := exchange.New(r, w, currency)
+	defer s.Close()
+
+	add(t, w, "1", "A", "100")
+	add(t, w, "2", "B", "100")
+	add(t, w, "3", "B", "100")
+
+	order1 := placeLimit(t, s, "2", exchange.Sell, "2", "10")
+
+	// orders stopped at fills limit before restart
+	add(t, w, "1", "A", "-10")
+	order2, _ := r.CreateOrder(ctx, exchange.Order{
+		UserID:      "1",
+		Market:      market,
+		Type:        exchange.Market,
+		Side:        exchange.Buy,
+		Status:      exchange.PartiallyFilled,
+		Rate:        d("2"),
+		Value:       d("10"),
+		Remaining:   d("5"),
+		Filled:      d("5"),
+		AverageRate: d("2"),
+	})
+	add(t, w, "3", "B", "-10")
+	order3, _ := r.CreateOrder(ctx, exchange.Order{
+		UserID:      "3",
+		Market:      market,
+		Type:        exchange.Limit,
+		Side:        exchange.Sell,
+		Status:      exchange.Active,
+		Rate:        d("3"),
+		Value:       d("10"),
+		Remaining:   d("10"),
+		TimeInForce: exchange.IOC,
+	})
+
+	// new exchange instance continues pending orders instead of resting them in the book
+	s = exchange.New(r, w, currency)
+	defer s.Close()
+
+	depth, err := s.GetDepth(ctx, market, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, depth.Asks, 1) {
+		assert.Equal(t, d("2").String(), depth.Asks[0].Rate.String())
+	}
+
+	// wait for pending matching
+	assert.NoError(t, s.Close())
+
+	remain(t, r, order1, "5")
+	remain(t, r, order2, "0")
+	status(t, r, order2, exchange.Matched)
+	status(t, r, order3, exchange.Cancelled)
+	bal(t, w, "1", "A", "90")
+	bal(t, w, "1", "B", "5")
+	bal(t, w, "2", "A", "10")
+	bal(t, w, "3", "B", "100")
+}
+
+// memoryTxRunner rolls back repositories to snapshot when transaction failed
+type memoryTxRunner struct {
+	exchangeRepo *memoryExchangeRepository
+	walletRepo   *memoryWalletRepository
+}
+
+func (tx *memoryTxRunner) RunInTx(ctx context.Context, f func(ctx context.Context) error) error {
+	data := append([]exchange.Order(nil), tx.exchangeRepo.data...)
+	trades := append([]exchange.Trade(nil), tx.exchangeRepo.trades...)
+	dust := make(map[string]decimal.Decimal)
+	for currency, value := range tx.exchangeRepo.dust {
+		dust[currency] = value
+	}
+	balances := make(map[string]map[string]decimal.Decimal)
+	for userID, m := range tx.walletRepo.data {
+		balances[userID] = make(map[string]decimal.Decimal)
+		for currency, value := range m {
+			balances[userID][currency] = value
+		}
+	}
+
+	err := f(ctx)
+	if err != nil {
+		tx.exchangeRepo.data = data
+		tx.exchangeRepo.trades = trades
+		tx.exchangeRepo.dust = dust
+		tx.walletRepo.data = balances
+	}
+	return err
+}
+
+func TestExchangeTxRollback(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	wr := new(memoryWalletRepository)
+	w := wallet.New(wr)
+	errFee := errors.New("fee error")
+	failFee := true
+	s := exchange.NewWithConfig(exchange.Config{
+		Repository: r,
+		Wallet:     w,
+		Currency:   currency,
+		FeeSchedule: exchange.FeeScheduleFunc(func(ctx context.Context, req exchange.FeeRequest) (decimal.Decimal, error) {
+			if failFee {
+				return decimal.Zero, errFee
+			}
+			return fee.Fee(ctx, req)
+		}),
+		TxRunner: &memoryTxRunner{exchangeRepo: r, walletRepo: wr},
+	})
+	defer s.Close()
+
+	add(t, w, "1", "A", "100")
+	add(t, w, "2", "B", "100")
+
+	order1 := placeLimit(t, s, "2", exchange.Sell, "2", "10")
+
+	// matching failed after maker updated, everything must roll back
+	_, err := s.PlaceLimitOrder(ctx, "1", market, exchange.Buy, d("2"), d("10"))
+	assert.Equal(t, errFee, err)
+	assert.Len(t, r.data, 1)
+	assert.Empty(t, r.trades)
+	remain(t, r, order1, "10")
+	status(t, r, order1, exchange.Active)
+	bal(t, w, "1", "A", "100")
+	bal(t, w, "2", "B", "90")
+
+	failFee = false
+	order2 := placeLimit(t, s, "1", exchange.Buy, "2", "10")
+	status(t, r, order1, exchange.Matched)
+	status(t, r, order2, exchange.Matched)
+	bal(t, w, "1", "A", "80")
+	bal(t, w, "1", "B", "9.975")
+	bal(t, w, "2", "A", "19.95")
+}
+
+func TestExchangeConcurrentOrders(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "1000")
+	add(t, w, "2", "B", "1000")
+
+	const n = 50
+	var wg sync.WaitGroup
+	wg.Add(2 * n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			_, err := s.PlaceLimitOrder(ctx, "2", market, exchange.Sell, d("2"), d("1"))
+			assert.NoError(t, err)
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := s.PlaceLimitOrder(ctx, "1", market, exchange.Buy, d("2"), d("1"))
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	for _, order := range r.data {
+		assert.Equal(t, exchange.Matched, order.Status)
+	}
+	assert.Len(t, r.trades, n)
+	bal(t, w, "1", "A", "900")
+	bal(t, w, "1", "B", "49.875")
+	bal(t, w, "2", "A", "99.75")
+	bal(t, w, "2", "B", "950")
+}
+
+func TestExchangeClose(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "100")
+
+	placeLimit(t, s, "1", exchange.Buy, "2", "10")
+
+	assert.NoError(t, s.Close())
+
+	_, err := s.PlaceLimitOrder(ctx, "1", market, exchange.Buy, d("2"), d("10"))
+	assert.Equal(t, exchange.ErrClosed, err)
+	bal(t, w, "1", "A", "80")
+}
+
+// hookContext closes hook when caller starts waiting on the context
+type hookContext struct {
+	context.Context
+	once sync.Once
+	hook chan struct{}
+}
+
+func (ctx *hookContext) Done() <-chan struct{} {
+	ctx.once.Do(func() { close(ctx.hook) })
+	return ctx.Context.Done()
+}
+
+func TestExchangeClosePending(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	blocked := make(chan struct{})
+	unblock := make(chan struct{})
+	var fees int
+	s := exchange.NewWithConfig(exchange.Config{
+		Repository: r,
+		Wallet:     w,
+		Currency:   currency,
+		FeeSchedule: exchange.FeeScheduleFunc(func(ctx context.Context, req exchange.FeeRequest) (decimal.Decimal, error) {
+			// block pending matching at second fill
+			fees++
+			if fees == 3 {
+				close(blocked)
+				<-unblock
+			}
+			return decimal.Zero, nil
+		}),
+		MaxFills: 1,
+		ErrorHandler: func(err error) {
+			assert.NoError(t, err)
+		},
+	})
+	defer s.Close()
+
+	add(t, w, "1", "A", "1000")
+	add(t, w, "2", "B", "1000")
+
+	for i := 0; i < 3; i++ {
+		placeLimit(t, s, "2", exchange.Sell, "2", "10")
+	}
+	order1 := placeLimit(t, s, "1", exchange.Buy, "2", "30")
+	<-blocked
+
+	// queue a command while worker is continuing pending matching
+	queued := &hookContext{Context: ctx, hook: make(chan struct{})}
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.PlaceLimitOrder(queued, "1", market, exchange.Buy, d("2"), d("10"))
+		errs <- err
+	}()
+	<-queued.hook
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- s.Close()
+	}()
+	for {
+		_, err := s.GetDepth(ctx, "C/A", 0)
+		if err == exchange.ErrClosed {
+			break
+		}
+	}
+	close(unblock)
+
+	// pending matching finishes, queued command does not run
+	assert.NoError(t, <-closed)
+	assert.Equal(t, exchange.ErrClosed, <-errs)
+	remain(t, r, order1, "0")
+	status(t, r, order1, exchange.Matched)
+	assert.Len(t, r.data, 4)
+	bal(t, w, "1", "A", "940")
+}
+
+func TestExchangeMaxFills(t *testing.T) {
+	t.Parallel()
+
+	var txs int
+	newLimitedExchange := func(r exchange.Repository, w wallet.Wallet) exchange.Exchange {
+		txs = 0
+		return exchange.NewWithConfig(exchange.Config{
+			Repository: r,
+			Wallet:     w,
+			Currency:   currency,
+			TxRunner: exchange.TxRunnerFunc(func(ctx context.Context, f func(ctx context.Context) error) error {
+				txs++
+				return f(ctx)
+			}),
+			MaxFills: 2,
+			ErrorHandler: func(err error) {
+				assert.NoError(t, err)
+			},
+		})
+	}
+
+	t.Run("Limit", func(t *testing.T) {
+		r := new(memoryExchangeRepository)
+		w := wallet.New(new(memoryWalletRepository))
+		s := newLimitedExchange(r, w)
+		defer s.Close()
+
+		add(t, w, "1", "A", "1000")
+		add(t, w, "2", "B", "1000")
+
+		var sellOrders []string
+		for i := 0; i < 5; i++ {
+			sellOrders = append(sellOrders, placeLimit(t, s, "2", exchange.Sell, "2", "10"))
+		}
+
+		// limit order continues matching after fills limit
+		order1 := placeLimit(t, s, "1", exchange.Buy, "2", "45")
+
+		// wait for pending matching
+		assert.NoError(t, s.Close())
+
+		// 5 sell orders, then buy order matches in 3 transactions
+		assert.Equal(t, 8, txs)
+
+		for _, orderID := range sellOrders[:4] {
+			status(t, r, orderID, exchange.Matched)
+		}
+		remain(t, r, sellOrders[4], "5")
+		status(t, r, sellOrders[4], exchange.PartiallyFilled)
+		remain(t, r, order1, "0")
+		status(t, r, order1, exchange.Matched)
+		bal(t, w, "1", "A", "910")
+		bal(t, w, "1", "B", "45")
+		bal(t, w, "2", "A", "90")
+	})
+
+	t.Run("Market", func(t *testing.T) {
+		r := new(memoryExchangeRepository)
+		w := wallet.New(new(memoryWalletRepository))
+		s := newLimitedExchange(r, w)
+		defer s.Close()
+
+		add(t, w, "1", "A", "1000")
+		add(t, w, "2", "B", "1000")
+
+		order1 := placeLimit(t, s, "2", exchange.Sell, "2", "10")
+		order2 := placeLimit(t, s, "2", exchange.Sell, "2", "10")
+
+		// market order cancels the remaining after matching finished
+		order3, err := s.PlaceMarketOrder(ctx, "1", market, exchange.Buy, d("25"))
+		assert.NoError(t, err)
+
+		assert.NoError(t, s.Close())
+
+		// 2 sell orders, then market order in 2 transactions
+		assert.Equal(t, 4, txs)
+
+		status(t, r, order1, exchange.Matched)
+		status(t, r, order2, exchange.Matched)
+		remain(t, r, order3, "5")
+		status(t, r, order3, exchange.PartiallyCancelled)
+		bal(t, w, "1", "A", "960")
+		bal(t, w, "1", "B", "20")
+		bal(t, w, "2", "A", "40")
+	})
+}
+
+func TestExchangePendingFailed(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	wr := new(memoryWalletRepository)
+	w := wallet.New(wr)
+	errFee := errors.New("fee error")
+	var fees int
+	var errs []error
+	s := exchange.NewWithConfig(exchange.Config{
+		Repository: r,
+		Wallet:     w,
+		Currency:   currency,
+		FeeSchedule: exchange.FeeScheduleFunc(func(ctx context.Context, req exchange.FeeRequest) (decimal.Decimal, error) {
+			// fail after first fill
+			fees++
+			if fees > 2 {
+				return decimal.Zero, errFee
+			}
+			return decimal.Zero, nil
+		}),
+		TxRunner: &memoryTxRunner{exchangeRepo: r, walletRepo: wr},
+		MaxFills: 1,
+		ErrorHandler: func(err error) {
+			errs = append(errs, err)
+		},
+	})
+	defer s.Close()
+
+	add(t, w, "1", "A", "1000")
+	add(t, w, "2", "B", "1000")
+
+	order1 := placeLimit(t, s, "2", exchange.Sell, "2", "10")
+	order2 := placeLimit(t, s, "2", exchange.Sell, "2", "10")
+
+	order3, err := s.PlaceMarketOrder(ctx, "1", market, exchange.Buy, d("25"))
+	assert.NoError(t, err)
+
+	// wait for pending matching
+	assert.NoError(t, s.Close())
+
+	// failed continuation rolls back, then the order is cancelled
+	assert.Equal(t, []error{errFee}, errs)
+	status(t, r, order1, exchange.Matched)
+	remain(t, r, order2, "10")
+	status(t, r, order2, exchange.Active)
+	remain(t, r, order3, "15")
+	status(t, r, order3, exchange.PartiallyCancelled)
+	bal(t, w, "1", "A", "980")
+	bal(t, w, "1", "B", "10")
+	bal(t, w, "2", "A", "20")
+}
+
+func TestExchangeContextCancelled(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	add(t, w, "1", "A", "100")
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	_, err := s.PlaceLimitOrder(ctx, "1", market, exchange.Buy, d("2"), d("10"))
+	assert.Equal(t, context.Canceled, err)
+	assert.Empty(t, r.data)
+	bal(t, w, "1", "A", "100")
+}
+
+func TestExchangeContextCancelledWhileMatching(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s := exchange.NewWithConfig(exchange.Config{
+		Repository: r,
+		Wallet:     w,
+		Currency:   currency,
+		FeeSchedule: exchange.FeeScheduleFunc(func(ctx context.Context, req exchange.FeeRequest) (decimal.Decimal, error) {
+			// caller gone after first fill
+			cancel()
+			return decimal.Zero, nil
+		}),
+		ErrorHandler: func(err error) {
+			assert.NoError(t, err)
+		},
+	})
+	defer s.Close()
+
+	add(t, w, "1", "A", "100")
+	add(t, w, "2", "B", "100")
+
+	order1, err := s.PlaceLimitOrder(context.Background(), "2", market, exchange.Sell, d("2"), d("10"))
+	assert.NoError(t, err)
+	order2, err := s.PlaceLimitOrder(context.Background(), "2", market, exchange.Sell, d("2"), d("10"))
+	assert.NoError(t, err)
+
+	// settled fills must not return as an error, the order continues matching
+	order3, err := s.PlaceLimitOrder(ctx, "1", market, exchange.Buy, d("2"), d("20"))
+	assert.NoError(t, err)
+
+	// wait for pending matching
+	assert.NoError(t, s.Close())
+
+	status(t, r, order1, exchange.Matched)
+	status(t, r, order2, exchange.Matched)
+	remain(t, r, order3, "0")
+	status(t, r, order3, exchange.Matched)
+	bal(t, w, "1", "A", "60")
+	bal(t, w, "1", "B", "20")
+	bal(t, w, "2", "A", "40")
+	bal(t, w, "2", "B", "80")
+}
+
+func TestExchangeSelfTradePrevention(t *testing.T) {
+	t.Parallel()
+
+	newSTPExchange := func(r exchange.Repository, w wallet.Wallet, stp exchange.SelfTradePrevention) exchange.Exchange {
+		return exchange.NewWithConfig(exchange.Config{
+			Repository:          r,
+			Wallet:              w,
+			Currency:            currency,
+			SelfTradePrevention: stp,
+			AccountGroup: func(ctx context.Context, userID string) string {
+				if userID == "1" || userID == "3" {
+					return "group1"
+				}
+				return ""
+			},
+		})
+	}
+
+	setup := func(t *testing.T, stp exchange.SelfTradePrevention) (*memoryExchangeRepository, wallet.Wallet, []string) {
+		r := new(memoryExchangeRepository)
+		w := wallet.New(new(memoryWalletRepository))
+		s := newSTPExchange(r, w, stp)
+		defer s.Close()
+		t.Cleanup(func() { s.Close() })
+
+		add(t, w, "1", "A", "1000")
+		add(t, w, "1", "B", "1000")
+		add(t, w, "2", "B", "1000")
+
+		order1 := placeLimit(t, s, "1", exchange.Sell, "2", "10")
+		order2 := placeLimit(t, s, "2", exchange.Sell, "3", "10")
+		order3 := placeLimit(t, s, "1", exchange.Buy, "3", "15")
+		return r, w, []string{order1, order2, order3}
+	}
+
+	t.Run("CancelNewest", func(t *testing.T) {
+		r, w, orders := setup(t, exchange.CancelNewest)
+
+		remain(t, r, orders[0], "10")
+		status(t, r, orders[0], exchange.Active)
+		status(t, r, orders[1], exchange.Active)
+		status(t, r, orders[2], exchange.Cancelled)
+		bal(t, w, "1", "A", "1000")
+		bal(t, w, "1", "B", "990")
+	})
+
+	t.Run("CancelOldest", func(t *testing.T) {
+		r, w, orders := setup(t, exchange.CancelOldest)
+
+		status(t, r, orders[0], exchange.Cancelled)
+		status(t, r, orders[1], exchange.Matched)
+		remain(t, r, orders[2], "5")
+		status(t, r, orders[2], exchange.PartiallyFilled)
+		bal(t, w, "1", "A", "955")
+		bal(t, w, "1", "B", "1010")
+		bal(t, w, "2", "A", "30")
+	})
+
+	t.Run("CancelBoth", func(t *testing.T) {
+		r, w, orders := setup(t, exchange.CancelBoth)
+
+		status(t, r, orders[0], exchange.Cancelled)
+		status(t, r, orders[1], exchange.Active)
+		status(t, r, orders[2], exchange.Cancelled)
+		bal(t, w, "1", "A", "1000")
+		bal(t, w, "1", "B", "1000")
+	})
+
+	t.Run("DecrementAndCancel", func(t *testing.T) {
+		r, w, orders := setup(t, exchange.DecrementAndCancel)
+
+		remain(t, r, orders[0], "0")
+		status(t, r, orders[0], exchange.Cancelled)
+		remain(t, r, orders[1], "5")
+		status(t, r, orders[1], exchange.PartiallyFilled)
+		remain(t, r, orders[2], "0")
+		status(t, r, orders[2], exchange.Matched)
+		bal(t, w, "1", "A", "985")
+		bal(t, w, "1", "B", "1005")
+		bal(t, w, "2", "A", "15")
+		assert.Len(t, r.trades, 1)
+	})
+
+	t.Run("FillOrKill", func(t *testing.T) {
+		r := new(memoryExchangeRepository)
+		w := wallet.New(new(memoryWalletRepository))
+		s := newSTPExchange(r, w, exchange.CancelOldest)
+		defer s.Close()
+
+		add(t, w, "1", "A", "1000")
+		add(t, w, "1", "B", "1000")
+		add(t, w, "2", "B", "1000")
+
+		order1 := placeLimit(t, s, "1", exchange.Sell, "2", "10")
+		order2 := placeLimit(t, s, "2", exchange.Sell, "2", "5")
+
+		// own order is not liquidity
+		_, err := s.PlaceLimitOrderWithOptions(ctx, "1", market, exchange.Buy, d("2"), d("15"), exchange.LimitOrderOptions{TimeInForce: exchange.FOK})
+		assert.Equal(t, exchange.ErrCannotFill, err)
+		status(t, r, order1, exchange.Active)
+		status(t, r, order2, exchange.Active)
+		bal(t, w, "1", "A", "1000")
+
+		order3, err := s.PlaceLimitOrderWithOptions(ctx, "1", market, exchange.Buy, d("2"), d("5"), exchange.LimitOrderOptions{TimeInForce: exchange.FOK})
+		assert.NoError(t, err)
+		status(t, r, order1, exchange.Cancelled)
+		status(t, r, order2, exchange.Matched)
+		status(t, r, order3, exchange.Matched)
+		bal(t, w, "1", "A", "990")
+		bal(t, w, "1", "B", "1005")
+
+		// taker order can not fill through own order
+		r = new(memoryExchangeRepository)
+		w = wallet.New(new(memoryWalletRepository))
+		s = newSTPExchange(r, w, exchange.CancelNewest)
+		defer s.Close()
+
+		add(t, w, "1", "A", "1000")
+		add(t, w, "1", "B", "1000")
+		add(t, w, "2", "B", "1000")
+
+		order1 = placeLimit(t, s, "2", exchange.Sell, "2", "5")
+		order2 = placeLimit(t, s, "1", exchange.Sell, "2", "10")
+		order3 = placeLimit(t, s, "2", exchange.Sell, "2", "10")
+
+		_, err = s.PlaceLimitOrderWithOptions(ctx, "1", market, exchange.Buy, d("2"), d("15"), exchange.LimitOrderOptions{TimeInForce: exchange.FOK})
+		assert.Equal(t, exchange.ErrCannotFill, err)
+		status(t, r, order1, exchange.Active)
+		status(t, r, order2, exchange.Active)
+		status(t, r, order3, exchange.Active)
+		bal(t, w, "1", "A", "1000")
+	})
+
+	t.Run("AccountGroup", func(t *testing.T) {
+		r := new(memoryExchangeRepository)
+		w := wallet.New(new(memoryWalletRepository))
+		s := newSTPExchange(r, w, exchange.CancelNewest)
+		defer s.Close()
+
+		add(t, w, "1", "A", "1000")
+		add(t, w, "3", "B", "1000")
+
+		order1 := placeLimit(t, s, "3", exchange.Sell, "2", "10")
+		order2 := placeLimit(t, s, "1", exchange.Buy, "2", "10")
+
+		status(t, r, order1, exchange.Active)
+		status(t, r, order2, exchange.Cancelled)
+		bal(t, w, "1", "A", "1000")
+	})
+}
+
+func TestExchangeIceberg(t *testing.T) {
+	t.Parallel()
+
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := exchange.New(r, w, currency)
+	defer s.Close()
+
+	add(t, w, "1", "A", "1000")
+	add(t, w, "2", "B", "1000")
+	add(t, w, "3", "B", "1000")
+
+	_, err := s.PlaceLimitOrderWithOptions(ctx, "2", market, exchange.Sell, d("2"), d("100"), exchange.LimitOrderOptions{DisplayValue: d("100")})
+	assert.Equal(t, exchange.ErrInvalidDisplayValue, err)
+	_, err = s.PlaceLimitOrderWithOptions(ctx, "2", market, exchange.Sell, d("2"), d("100"), exchange.LimitOrderOptions{DisplayValue: d("10"), TimeInForce: exchange.IOC})
+	assert.Equal(t, exchange.ErrInvalidTimeInForce, err)
+
+	// iceberg order reserves the whole value
+	order1, err := s.PlaceLimitOrderWithOptions(ctx, "2", market, exchange.Sell, d("2"), d("100"), exchange.LimitOrderOptions{DisplayValue: d("10")})
+	assert.NoError(t, err)
+	bal(t, w, "2", "B", "900")
+
+	order2 := placeLimit(t, s, "3", exchange.Sell, "2", "20")
+
+	depth, err := s.GetDepth(ctx, market, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, depth.Asks, 1) {
+		assert.Equal(t, d("30").String(), depth.Asks[0].Value.String())
+	}
+	assert.Empty(t, depth.Bids)
+
+	// preview does not reveal hidden value
+	p, err := s.PreviewMarketOrder(ctx, market, exchange.Buy, d("50"), exchange.MarketOrderOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, d("30").String(), p.Amount.String())
+	assert.Equal(t, d("20").String(), p.Remaining.String())
+
+	// visible slice filled, refreshed slice goes behind order2
+	order3 := placeLimit(t, s, "1", exchange.Buy, "2", "15")
+	remain(t, r, order1, "90")
+	remain(t, r, order2, "15")
+	remain(t, r, order3, "0")
+
+	depth, _ = s.GetDepth(ctx, market, 0)
+	assert.Equal(t, d("25").String(), depth.Asks[0].Value.String())
+
+	order4 := placeLimit(t, s, "1", exchange.Buy, "2", "30")
+	status(t, r, order2, exchange.Matched)
+	remain(t, r, order1, "75")
+	status(t, r, order1, exchange.PartiallyFilled)
+	remain(t, r, order4, "0")
+
+	depth, _ = s.GetDepth(ctx, market, 0)
+	assert.Equal(t, d("5").String(), depth.Asks[0].Value.String())
+
+	bal(t, w, "1", "A", "910")
+	bal(t, w, "1", "B", "45")
+	bal(t, w, "2", "A", "50")
+	bal(t, w, "3", "A", "40")
+}
+
+func BenchmarkExchangeLimitOrder(b *testing.B) {
+	r := new(memoryExchangeRepository)
+	w := wallet.New(new(memoryWalletRepository))
+	s := newExchange(r, w)
+	defer s.Close()
+
+	w.Add(ctx, "1", "A", d("1000000000"))
+	w.Add(ctx, "2", "B", d("1000000000"))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.PlaceLimitOrder(ctx, "2", market, exchange.Sell, d("2"), d("1"))
+		s.PlaceLimitOrder(ctx, "1", market, exchange.Buy, d("2"), d("1"))
+	}
+}
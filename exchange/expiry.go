@@ -0,0 +1,44 @@
+package exchange
+
+import (
+	"context"
+	"time"
+)
+
+func (s *service) CancelExpiredOrders(ctx context.Context, now time.Time) ([]CancelResult, error) {
+	orders, err := s.repo.ListExpiredOrders(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.cancelOrders(ctx, orders), nil
+}
+
+// RunExpirySweeper cancels expired good-till-date orders every interval until context is done,
+// errors are reported to errHandler (nil for ignore) and the sweeper continues on next tick
+func RunExpirySweeper(ctx context.Context, ex Exchange, interval time.Duration, errHandler func(err error)) error {
+	if errHandler == nil {
+		errHandler = func(err error) {}
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-t.C:
+			results, err := ex.CancelExpiredOrders(ctx, now)
+			if err != nil {
+				errHandler(err)
+				continue
+			}
+			for _, result := range results {
+				if result.Err != nil {
+					errHandler(result.Err)
+				}
+			}
+		}
+	}
+}
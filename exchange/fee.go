@@ -0,0 +1,192 @@
+package exchange
+
+import (
+	"context"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Liquidity is order's liquidity role in a trade
+type Liquidity int
+
+// Liquidity values
+const (
+	Maker Liquidity = iota
+	Taker
+)
+
+// FeeRequest is the trade information for calculating fee
+type FeeRequest struct {
+	UserID    string
+	Market    string
+	Side      Side
+	Liquidity Liquidity
+	Tier      int
+	Volume    decimal.Decimal // user's 30-day trading volume
+	Rate      decimal.Decimal
+	Amount    decimal.Decimal
+}
+
+// FeeSchedule calculates trade fee in trade amount unit,
+// negative fee is a rebate that paid from fee account
+type FeeSchedule interface {
+	Fee(ctx context.Context, req FeeRequest) (decimal.Decimal, error)
+}
+
+// UserStatsFeeSchedule is an optional interface for FeeSchedule
+// to tell whether it needs user's tier and volume in FeeRequest,
+// FeeSchedule that does not implement it always gets user's tier and volume
+type UserStatsFeeSchedule interface {
+	FeeSchedule
+	NeedsUserStats() bool
+}
+
+// FeeScheduleFunc is an adapter to use function as FeeSchedule
+type FeeScheduleFunc func(ctx context.Context, req FeeRequest) (decimal.Decimal, error)
+
+// Fee calls f(ctx, req)
+func (f FeeScheduleFunc) Fee(ctx context.Context, req FeeRequest) (decimal.Decimal, error) {
+	return f(ctx, req)
+}
+
+// FeeRate is a FeeSchedule that charges flat maker and taker rates of trade amount
+type FeeRate struct {
+	Maker decimal.Decimal
+	Taker decimal.Decimal
+}
+
+// Fee calculates fee from liquidity role
+func (r FeeRate) Fee(ctx context.Context, req FeeRequest) (decimal.Decimal, error) {
+	if req.Liquidity == Maker {
+		return req.Amount.Mul(r.Maker), nil
+	}
+	return req.Amount.Mul(r.Taker), nil
+}
+
+// NeedsUserStats returns false, flat rates do not use user's tier and volume
+func (r FeeRate) NeedsUserStats() bool {
+	return false
+}
+
+const feeVolumePeriod = 30 * 24 * time.Hour
+
+// feeUser is user's tier and volume for calculating fee
+type feeUser struct {
+	tier   int
+	volume decimal.Decimal
+}
+
+// feeUsers caches users' tier and volume for a matching call,
+// so each user loads from repository once however many fills
+type feeUsers map[string]*feeUser
+
+func (s *service) getFeeUser(ctx context.Context, users feeUsers, userID string) (*feeUser, error) {
+	if u := users[userID]; u != nil {
+		return u, nil
+	}
+
+	tier, err := s.repo.GetUserFeeTier(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	volume, err := s.repo.GetUserVolume(ctx, userID, time.Now().Add(-feeVolumePeriod))
+	if err != nil {
+		return nil, err
+	}
+
+	u := &feeUser{tier: tier, volume: volume}
+	users[userID] = u
+	return u, nil
+}
+
+func needsUserStats(fee FeeSchedule) bool {
+	if fee, ok := fee.(UserStatsFeeSchedule); ok {
+		return fee.NeedsUserStats()
+	}
+	return true
+}
+
+func (s *service) getFee(ctx context.Context, users feeUsers, order *Order, liquidity Liquidity, rate, amount decimal.Decimal) (decimal.Decimal, error) {
+	if s.fee == nil {
+		return decimal.Zero, nil
+	}
+
+	req := FeeRequest{
+		UserID:    order.UserID,
+		Market:    order.Market,
+		Side:      order.Side,
+		Liquidity: liquidity,
+		Rate:      rate,
+		Amount:    amount,
+	}
+
+	if needsUserStats(s.fee) {
+		u, err := s.getFeeUser(ctx, users, order.UserID)
+		if err != nil {
+			return decimal.Zero, err
+		}
+		req.Tier = u.tier
+		req.Volume = u.volume
+	}
+
+	fee, err := s.fee.Fee(ctx, req)
+	if err != nil {
+		return decimal.Zero, err
+	}
+
+	// fee can not take more than trade amount
+	if fee.GreaterThan(amount) {
+		return decimal.Zero, ErrInvalidFee
+	}
+
+	return fee, nil
+}
+
+// chargedFee converts fee in trade amount unit to the currency order receives,
+// buyer pays fee in sell currency and seller pays fee in buy currency,
+// fee rounds up to currency's precision
+func (s *service) chargedFee(ctx context.Context, order *Order, rate, fee decimal.Decimal) decimal.Decimal {
+	if order.Side == Sell {
+		fee = fee.Mul(rate)
+	}
+	if s.precision != nil {
+		fee = fee.RoundCeil(s.precision(ctx, s.receiveCurrency(ctx, order)))
+	}
+	return fee
+}
+
+// payableFee returns charged fee that fee account can pay,
+// rebate is paid from fee account's balance, so fee account must be pre-funded,
+// the order gets no rebate when there is no fee account or its balance is not enough
+func (s *service) payableFee(ctx context.Context, order *Order, fee decimal.Decimal) (decimal.Decimal, error) {
+	if fee.GreaterThanOrEqual(decimal.Zero) {
+		return fee, nil
+	}
+	if s.feeAccount == nil {
+		return decimal.Zero, nil
+	}
+
+	currency := s.receiveCurrency(ctx, order)
+	balance, err := s.wallet.Balance(ctx, s.feeAccount(ctx, currency), currency)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	if balance.LessThan(fee.Neg()) {
+		return decimal.Zero, nil
+	}
+	return fee, nil
+}
+
+// collectFee credits charged fee paid by order to fee account
+func (s *service) collectFee(ctx context.Context, order *Order, fee decimal.Decimal) error {
+	if s.feeAccount == nil {
+		return nil
+	}
+
+	currency := s.receiveCurrency(ctx, order)
+
+	// negative fee is a rebate paid from fee account
+	return s.addBalance(ctx, s.feeAccount(ctx, currency), currency, fee)
+}
@@ -0,0 +1,185 @@
+package exchange
+
+import (
+	"context"
+
+	"github.com/shopspring/decimal"
+)
+
+// OCOOrder is one-cancels-the-other order,
+// a take-profit limit order and a stop-loss stop order with the same side and value
+type OCOOrder struct {
+	Side          Side
+	Rate          decimal.Decimal // limit order rate
+	StopRate      decimal.Decimal
+	StopLimitRate decimal.Decimal // stop-limit order rate, zero for stop-market order
+	Value         decimal.Decimal
+}
+
+func (s *service) PlaceOCOOrder(ctx context.Context, userID string, market string, oco OCOOrder) (string, string, error) {
+	if oco.Value.LessThanOrEqual(decimal.Zero) {
+		return "", "", ErrInvalidValue
+	}
+	if oco.Rate.LessThanOrEqual(decimal.Zero) || oco.StopLimitRate.LessThan(decimal.Zero) {
+		return "", "", ErrInvalidRate
+	}
+	if oco.StopRate.LessThanOrEqual(decimal.Zero) {
+		return "", "", ErrInvalidStopRate
+	}
+	if !ValidSide(oco.Side) {
+		return "", "", ErrInvalidSide
+	}
+	if !s.validMarket(ctx, market) {
+		return "", "", ErrInvalidMarket
+	}
+
+	// stop loss must be at worse rate than take profit
+	if !better(oco.Side, oco.StopRate, oco.Rate) {
+		return "", "", ErrInvalidStopRate
+	}
+
+	limitOrder := Order{
+		UserID:    userID,
+		Market:    market,
+		Type:      Limit,
+		Side:      oco.Side,
+		Rate:      oco.Rate,
+		Value:     oco.Value,
+		Remaining: oco.Value,
+		Status:    Active,
+	}
+	stopOrder := Order{
+		UserID:    userID,
+		Market:    market,
+		Type:      StopMarket,
+		Side:      oco.Side,
+		StopRate:  oco.StopRate,
+		Value:     oco.Value,
+		Remaining: oco.Value,
+		Status:    Active,
+	}
+	if !oco.StopLimitRate.IsZero() {
+		stopOrder.Type = StopLimit
+		stopOrder.Rate = oco.StopLimitRate
+	}
+
+	err := s.checkRules(ctx, &limitOrder)
+	if err != nil {
+		return "", "", err
+	}
+	err = s.checkRules(ctx, &stopOrder)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = s.execute(ctx, market, func(ctx context.Context, book *orderBook) error {
+		return s.runInTx(ctx, book, func(ctx context.Context) error {
+			// group reserves funds once for the larger order
+			reserved := decimal.Max(reservedValue(&limitOrder), reservedValue(&stopOrder))
+			err := s.addBalance(ctx, userID, s.getCurrency(ctx, market, oco.Side), reserved.Neg())
+			if err != nil {
+				return err
+			}
+
+			// group id is the limit order id
+			limitOrder.ID, err = s.repo.CreateOrder(ctx, limitOrder)
+			if err != nil {
+				return err
+			}
+			err = s.repo.SetOrderGroupID(ctx, limitOrder.ID, limitOrder.ID)
+			if err != nil {
+				return err
+			}
+
+			stopOrder.GroupID = limitOrder.ID
+			stopOrder.ID, err = s.repo.CreateOrder(ctx, stopOrder)
+			if err != nil {
+				return err
+			}
+			book.insertStop(&stopOrder)
+
+			_, err = s.matchingLimitOrder(ctx, book, limitOrder.ID)
+			if err != nil {
+				return err
+			}
+
+			return s.runTriggeredOrders(ctx, book)
+		})
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return limitOrder.ID, stopOrder.ID, nil
+}
+
+// cancelGroup cancels the other open orders in order's group,
+// order keeps its own reservation and the rest of group reservation is refunded
+func (s *service) cancelGroup(ctx context.Context, book *orderBook, order *Order) error {
+	if order.GroupID == "" {
+		return nil
+	}
+
+	orders, err := s.repo.ListGroupOrders(ctx, order.GroupID)
+	if err != nil {
+		return err
+	}
+
+	for i := range orders {
+		other := &orders[i]
+		if other.ID == order.ID || !other.Status.IsOpen() {
+			continue
+		}
+
+		if o := book.get(other.ID); o != nil {
+			book.remove(o)
+		}
+
+		err = s.repo.SetOrderStatus(ctx, other.ID, Cancelled)
+		if err != nil {
+			return err
+		}
+
+		err = s.repo.StampOrderFinished(ctx, other.ID)
+		if err != nil {
+			return err
+		}
+
+		// the other order never filled, group reserved the larger of both initial reservations
+		reserved := initialReservedValue(order)
+		refund := decimal.Max(reserved, initialReservedValue(other)).Sub(reserved)
+		err = s.addBalance(ctx, other.UserID, s.getCurrency(ctx, other.Market, other.Side), refund)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// groupOpen checks is another order in order's group still open,
+// the group shares reservation until the others are cancelled
+func (s *service) groupOpen(ctx context.Context, order *Order) (bool, error) {
+	if order.GroupID == "" {
+		return false, nil
+	}
+
+	orders, err := s.repo.ListGroupOrders(ctx, order.GroupID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, other := range orders {
+		if other.ID != order.ID && other.Status.IsOpen() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// initialReservedValue returns order's reservation before any fill
+func initialReservedValue(order *Order) decimal.Decimal {
+	o := *order
+	o.Remaining = o.Value
+	return reservedValue(&o)
+}
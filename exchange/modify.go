@@ -0,0 +1,103 @@
+package exchange
+
+import (
+	"context"
+
+	"github.com/shopspring/decimal"
+)
+
+func (s *service) ModifyOrder(ctx context.Context, userID string, orderID string, rate, remaining decimal.Decimal) error {
+	order, err := s.repo.GetOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+
+	if order.UserID != userID {
+		return ErrNotOrderOwner
+	}
+
+	return s.AdminModifyOrder(ctx, orderID, rate, remaining)
+}
+
+func (s *service) AdminModifyOrder(ctx context.Context, orderID string, rate, remaining decimal.Decimal) error {
+	if remaining.LessThanOrEqual(decimal.Zero) {
+		return ErrInvalidValue
+	}
+	if rate.LessThanOrEqual(decimal.Zero) {
+		return ErrInvalidRate
+	}
+
+	order, err := s.repo.GetOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	err = s.checkRules(ctx, &Order{Market: order.Market, Type: order.Type, Side: order.Side, Rate: rate, Value: remaining})
+	if err != nil {
+		return err
+	}
+
+	return s.execute(ctx, order.Market, func(ctx context.Context, book *orderBook) error {
+		return s.runInTx(ctx, book, func(ctx context.Context) error {
+			err := s.modifyOrder(ctx, book, orderID, rate, remaining)
+			if err != nil {
+				return err
+			}
+
+			return s.runTriggeredOrders(ctx, book)
+		})
+	})
+}
+
+func (s *service) modifyOrder(ctx context.Context, book *orderBook, orderID string, rate, remaining decimal.Decimal) error {
+	order := book.get(orderID)
+	if order == nil {
+		return ErrOrderNotActive
+	}
+	if order.Type != Limit {
+		return ErrInvalidType
+	}
+	grouped, err := s.groupOpen(ctx, order)
+	if err != nil {
+		return err
+	}
+	if grouped {
+		return ErrOrderGrouped
+	}
+
+	if order.PostOnly && !rate.Equal(order.Rate) && book.crosses(order.Side, rate) {
+		return ErrWouldTake
+	}
+
+	// adjust reservation by delta
+	modified := *order
+	modified.Rate = rate
+	modified.Value = order.Value.Sub(order.Remaining).Add(remaining)
+	modified.Remaining = remaining
+
+	err = s.addBalance(ctx, order.UserID, s.getCurrency(ctx, order.Market, order.Side), reservedValue(order).Sub(reservedValue(&modified)))
+	if err != nil {
+		return err
+	}
+
+	// size reduction keeps time priority
+	if rate.Equal(order.Rate) && remaining.LessThanOrEqual(order.Remaining) {
+		err = s.repo.SetOrderRateValueAndRemaining(ctx, order.ID, modified.Rate, modified.Value, modified.Remaining, false)
+		if err != nil {
+			return err
+		}
+
+		modified.visible = decimal.Min(modified.visible, remaining)
+		*order = modified
+		return nil
+	}
+
+	err = s.repo.SetOrderRateValueAndRemaining(ctx, order.ID, modified.Rate, modified.Value, modified.Remaining, true)
+	if err != nil {
+		return err
+	}
+
+	// re-run matching, the order will back to the book at the end of its price level
+	book.remove(order)
+	_, err = s.matchingLimitOrder(ctx, book, order.ID)
+	return err
+}
@@ -8,17 +8,32 @@ import (
 
 // Order type
 type Order struct {
-	ID         string
-	UserID     string
-	Type       Type
-	Side       Side
-	Status     Status
-	Rate       decimal.Decimal
-	Value      decimal.Decimal
-	Remaining  decimal.Decimal
-	CreatedAt  time.Time
-	MatchedAt  time.Time
-	FinishedAt time.Time
+	ID           string
+	UserID       string
+	Market       string
+	Type         Type
+	Side         Side
+	Status       Status
+	Rate         decimal.Decimal
+	StopRate     decimal.Decimal
+	WorstRate    decimal.Decimal
+	TrailOffset  decimal.Decimal // trailing stop's distance from last trade rate
+	TrailRatio   decimal.Decimal // trailing stop's distance in ratio of last trade rate
+	Value        decimal.Decimal
+	Remaining    decimal.Decimal
+	Filled       decimal.Decimal // cumulative filled amount
+	AverageRate  decimal.Decimal // volume-weighted average fill rate
+	TimeInForce  TimeInForce
+	ExpiresAt    time.Time
+	PostOnly     bool
+	QuoteValue   bool            // Value and Remaining are in buy currency
+	DisplayValue decimal.Decimal // iceberg order's visible slice value, zero for not iceberg
+	GroupID      string          // one-cancels-the-other group, empty for not grouped
+	CreatedAt    time.Time
+	MatchedAt    time.Time
+	FinishedAt   time.Time
+
+	visible decimal.Decimal // iceberg order's remaining visible value in the book
 }
 
 // Type is order type
@@ -28,8 +43,32 @@ type Type int
 const (
 	Limit Type = iota
 	Market
+	StopLimit
+	StopMarket
+	TrailingStop
 )
 
+// IsStop checks is type a stop order type
+func (t Type) IsStop() bool {
+	return t == StopLimit || t == StopMarket || t == TrailingStop
+}
+
+// TimeInForce is how long an order remains active
+type TimeInForce int
+
+// TimeInForce values
+const (
+	GTC TimeInForce = iota // good till cancelled
+	IOC                    // immediate or cancel
+	FOK                    // fill or kill
+	GTD                    // good till date
+)
+
+// ValidTimeInForce checks is time in force valid
+func ValidTimeInForce(tif TimeInForce) bool {
+	return tif >= GTC && tif <= GTD
+}
+
 // Status is order status
 type Status int
 
@@ -38,8 +77,15 @@ const (
 	Active Status = iota
 	Matched
 	Cancelled
+	PartiallyFilled
+	PartiallyCancelled // cancelled after partially filled
 )
 
+// IsOpen checks is order with status can still be filled
+func (s Status) IsOpen() bool {
+	return s == Active || s == PartiallyFilled
+}
+
 // Side is order side
 type Side int
 
@@ -53,3 +99,42 @@ const (
 func ValidSide(side Side) bool {
 	return side == Buy || side == Sell
 }
+
+// fill adds filled amount at rate to order
+func (o *Order) fill(rate, amount decimal.Decimal) {
+	total := o.AverageRate.Mul(o.Filled).Add(rate.Mul(amount))
+	o.Filled = o.Filled.Add(amount)
+	o.AverageRate = total.Div(o.Filled)
+	o.Status = PartiallyFilled
+}
+
+// expired checks is good-till-date order expired at now
+func (o *Order) expired(now time.Time) bool {
+	return o.TimeInForce == GTD && !o.ExpiresAt.After(now)
+}
+
+// isIceberg checks is order shows only a slice of remaining in the book
+func (o *Order) isIceberg() bool {
+	return o.DisplayValue.GreaterThan(decimal.Zero)
+}
+
+// display returns order's remaining value that visible in the book
+func (o *Order) display() decimal.Decimal {
+	if o.isIceberg() {
+		return o.visible
+	}
+	return o.Remaining
+}
+
+// trailingStopRate returns stop rate that trails rate by order's trail
+func (o *Order) trailingStopRate(rate decimal.Decimal) decimal.Decimal {
+	distance := o.TrailOffset
+	if !o.TrailRatio.IsZero() {
+		distance = rate.Mul(o.TrailRatio)
+	}
+
+	if o.Side == Buy {
+		return rate.Add(distance)
+	}
+	return rate.Sub(distance)
+}
@@ -0,0 +1,261 @@
+package exchange
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// orderBook is an in-memory price-time priority order book for a market
+type orderBook struct {
+	loaded bool
+	bids   []*priceLevel // sorted by rate descending
+	asks   []*priceLevel // sorted by rate ascending
+	orders map[string]*Order
+
+	stops     []*Order        // dormant stop orders
+	triggered []*Order        // stop orders waiting to convert
+	pending   []string        // orders reached fills limit, waiting to continue matching
+	lastRate  decimal.Decimal // last trade rate, zero if market has no trade
+}
+
+// priceLevel is a FIFO queue of orders at the same rate
+type priceLevel struct {
+	rate   decimal.Decimal
+	orders []*Order
+}
+
+func (b *orderBook) load(ctx context.Context, repo Repository, market string) error {
+	if b.loaded {
+		return nil
+	}
+
+	orders, err := repo.ListActiveLimitOrders(ctx, market)
+	if err != nil {
+		return err
+	}
+
+	stops, err := repo.ListActiveStopOrders(ctx, market)
+	if err != nil {
+		return err
+	}
+
+	trades, err := repo.ListTrades(ctx, market, 1)
+	if err != nil {
+		return err
+	}
+
+	active, err := repo.ListActiveOrders(ctx, OrderFilter{Market: market})
+	if err != nil {
+		return err
+	}
+
+	b.invalidate()
+	b.orders = make(map[string]*Order)
+	for i := range orders {
+		order := orders[i]
+
+		// open immediate or cancel order stopped while matching, it never rests in the book
+		if order.TimeInForce == IOC || order.TimeInForce == FOK {
+			b.queuePending(order.ID)
+			continue
+		}
+		b.insert(&order)
+	}
+	for _, order := range active {
+		// open market order stopped while matching
+		if order.Type == Market {
+			b.queuePending(order.ID)
+		}
+	}
+	for i := range stops {
+		order := stops[i]
+		b.insertStop(&order)
+	}
+	if len(trades) > 0 {
+		b.lastRate = trades[0].Rate
+	}
+	b.loaded = true
+
+	return nil
+}
+
+// queuePending queues order to continue matching if not queued
+func (b *orderBook) queuePending(orderID string) {
+	for _, id := range b.pending {
+		if id == orderID {
+			return
+		}
+	}
+	b.pending = append(b.pending, orderID)
+}
+
+// invalidate drops book state, the book will be rebuilt from repository on next load,
+// pending orders are kept since load can not tell pending limit orders from resting ones
+func (b *orderBook) invalidate() {
+	b.loaded = false
+	b.bids = nil
+	b.asks = nil
+	b.orders = nil
+	b.stops = nil
+	b.triggered = nil
+	b.lastRate = decimal.Zero
+}
+
+func (b *orderBook) levels(side Side) *[]*priceLevel {
+	if side == Buy {
+		return &b.bids
+	}
+	return &b.asks
+}
+
+// better checks is rate x has higher priority than y for given side
+func better(side Side, x, y decimal.Decimal) bool {
+	if side == Buy {
+		return x.GreaterThan(y)
+	}
+	return x.LessThan(y)
+}
+
+// search returns index of the first level that does not have higher priority than rate
+func (b *orderBook) search(side Side, rate decimal.Decimal) int {
+	levels := *b.levels(side)
+	return sort.Search(len(levels), func(i int) bool {
+		return !better(side, levels[i].rate, rate)
+	})
+}
+
+// insert appends order to the back of its price level,
+// iceberg order shows a new slice
+func (b *orderBook) insert(order *Order) {
+	if order.isIceberg() {
+		order.visible = decimal.Min(order.DisplayValue, order.Remaining)
+	}
+
+	levels := b.levels(order.Side)
+	i := b.search(order.Side, order.Rate)
+	if i < len(*levels) && (*levels)[i].rate.Equal(order.Rate) {
+		(*levels)[i].orders = append((*levels)[i].orders, order)
+	} else {
+		*levels = append(*levels, nil)
+		copy((*levels)[i+1:], (*levels)[i:])
+		(*levels)[i] = &priceLevel{rate: order.Rate, orders: []*Order{order}}
+	}
+	b.orders[order.ID] = order
+}
+
+// insertStop adds dormant stop order to the book
+func (b *orderBook) insertStop(order *Order) {
+	b.stops = append(b.stops, order)
+	b.orders[order.ID] = order
+}
+
+// remove removes order from the book
+func (b *orderBook) remove(order *Order) {
+	if order.Type.IsStop() {
+		for i, o := range b.stops {
+			if o.ID == order.ID {
+				b.stops = append(b.stops[:i], b.stops[i+1:]...)
+				break
+			}
+		}
+		delete(b.orders, order.ID)
+		return
+	}
+
+	levels := b.levels(order.Side)
+	i := b.search(order.Side, order.Rate)
+	if i >= len(*levels) || !(*levels)[i].rate.Equal(order.Rate) {
+		return
+	}
+
+	level := (*levels)[i]
+	for j, o := range level.orders {
+		if o.ID == order.ID {
+			level.orders = append(level.orders[:j], level.orders[j+1:]...)
+			break
+		}
+	}
+	if len(level.orders) == 0 {
+		*levels = append((*levels)[:i], (*levels)[i+1:]...)
+	}
+	delete(b.orders, order.ID)
+}
+
+// get gets order in the book
+func (b *orderBook) get(orderID string) *Order {
+	return b.orders[orderID]
+}
+
+// front returns the highest priority order for given side, or nil if side is empty
+func (b *orderBook) front(side Side) *Order {
+	levels := *b.levels(side)
+	if len(levels) == 0 {
+		return nil
+	}
+	return levels[0].orders[0]
+}
+
+// trigger moves stop orders that triggered by last trade rate to triggered queue
+func (b *orderBook) trigger(rate decimal.Decimal) {
+	stops := b.stops[:0]
+	for _, order := range b.stops {
+		if (order.Side == Buy && rate.GreaterThanOrEqual(order.StopRate)) ||
+			(order.Side == Sell && rate.LessThanOrEqual(order.StopRate)) {
+			b.triggered = append(b.triggered, order)
+			delete(b.orders, order.ID)
+			continue
+		}
+		stops = append(stops, order)
+	}
+	b.stops = stops
+}
+
+// crosses checks is order at given rate would match an opposite order
+func (b *orderBook) crosses(side Side, rate decimal.Decimal) bool {
+	opposite := Buy
+	if side == Buy {
+		opposite = Sell
+	}
+
+	order := b.front(opposite)
+	return order != nil && !better(opposite, rate, order.Rate)
+}
+
+// fillable checks is there enough opposite orders at given rate
+// to fill value immediately, own orders are skipped when skipOwn
+// or stop filling otherwise
+func (b *orderBook) fillable(side Side, rate, value decimal.Decimal, own func(order *Order) bool, skipOwn bool) bool {
+	opposite := Buy
+	if side == Buy {
+		opposite = Sell
+	}
+
+	now := time.Now()
+	for _, level := range *b.levels(opposite) {
+		if better(opposite, rate, level.rate) {
+			break
+		}
+		for _, order := range level.orders {
+			// expired order is cancelled when matching reaches it
+			if order.expired(now) {
+				continue
+			}
+
+			if own != nil && own(order) {
+				if skipOwn {
+					continue
+				}
+				return false
+			}
+
+			value = value.Sub(order.Remaining)
+			if value.LessThanOrEqual(decimal.Zero) {
+				return true
+			}
+		}
+	}
+	return false
+}
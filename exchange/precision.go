@@ -0,0 +1,78 @@
+package exchange
+
+import (
+	"context"
+
+	"github.com/shopspring/decimal"
+)
+
+// defaultAmountPrecision is the decimal places of amount that calculated from quote value,
+// when currency's precision is not configured
+const defaultAmountPrecision = 8
+
+// amountPrecision returns decimal places of market's sell currency
+func (s *service) amountPrecision(ctx context.Context, market string) int32 {
+	if s.precision == nil {
+		return defaultAmountPrecision
+	}
+	return s.precision(ctx, s.getCurrency(ctx, market, Sell))
+}
+
+// receiveCurrency returns currency that order receives from trade
+func (s *service) receiveCurrency(ctx context.Context, order *Order) string {
+	if order.Side == Buy {
+		return s.getCurrency(ctx, order.Market, Sell)
+	}
+	return s.getCurrency(ctx, order.Market, Buy)
+}
+
+// addBalance adds value to user's wallet rounded down to currency's precision,
+// so credit rounds down and debit rounds up, the residual dust goes to repository
+func (s *service) addBalance(ctx context.Context, userID string, currency string, value decimal.Decimal) error {
+	if s.precision == nil {
+		return s.wallet.Add(ctx, userID, currency, value)
+	}
+
+	rounded := value.RoundFloor(s.precision(ctx, currency))
+	err := s.wallet.Add(ctx, userID, currency, rounded)
+	if err != nil {
+		return err
+	}
+
+	dust := value.Sub(rounded)
+	if dust.IsZero() {
+		return nil
+	}
+	return s.repo.AddDust(ctx, currency, dust)
+}
+
+// validPrecision checks is order's value fit its currency's precision,
+// and buy order's reservation fits buy currency's precision so cancel refunds exactly what reserved
+func (s *service) validPrecision(ctx context.Context, order *Order) bool {
+	if s.precision == nil {
+		return true
+	}
+
+	currency := s.getCurrency(ctx, order.Market, Sell)
+	if order.QuoteValue {
+		currency = s.getCurrency(ctx, order.Market, Buy)
+	}
+	if !order.Value.Equal(order.Value.Truncate(s.precision(ctx, currency))) {
+		return false
+	}
+
+	if order.Side != Buy || order.QuoteValue {
+		return true
+	}
+	reserved := initialReservedValue(order)
+	return reserved.Equal(reserved.Truncate(s.precision(ctx, s.getCurrency(ctx, order.Market, Buy))))
+}
+
+// reserveRate rounds up buy order's reservation rate that derived from the book or last trade rate,
+// so remaining * rate fits buy currency's precision
+func (s *service) reserveRate(ctx context.Context, order *Order, rate decimal.Decimal) decimal.Decimal {
+	if s.precision == nil || order.Side != Buy || order.QuoteValue {
+		return rate
+	}
+	return rate.RoundCeil(s.precision(ctx, s.getCurrency(ctx, order.Market, Buy)) + order.Remaining.Exponent())
+}
@@ -0,0 +1,156 @@
+package exchange
+
+import (
+	"context"
+
+	"github.com/shopspring/decimal"
+)
+
+// MarketOrderPreview is the result of previewing market order
+type MarketOrderPreview struct {
+	BestRate    decimal.Decimal // best opposite rate
+	WorstRate   decimal.Decimal // worst rate the order would fill at
+	AverageRate decimal.Decimal
+	Amount      decimal.Decimal // amount would be filled, in sell currency
+	Total       decimal.Decimal // total rate * amount would be filled, in buy currency
+	Remaining   decimal.Decimal // value would be cancelled
+}
+
+func validMarketOrderOptions(opts MarketOrderOptions) error {
+	if opts.WorstRate.LessThan(decimal.Zero) {
+		return ErrInvalidRate
+	}
+	if opts.MaxSlippage.LessThan(decimal.Zero) || opts.MaxSlippage.GreaterThanOrEqual(decimal.New(1, 0)) {
+		return ErrInvalidSlippage
+	}
+	return nil
+}
+
+// worstRate returns the worst rate that market order can fill at,
+// or zero if no price protection
+func (b *orderBook) worstRate(side Side, opts MarketOrderOptions) decimal.Decimal {
+	rate := opts.WorstRate
+
+	if !opts.MaxSlippage.IsZero() {
+		opposite := Buy
+		if side == Buy {
+			opposite = Sell
+		}
+		best := b.front(opposite)
+		if best == nil {
+			return rate
+		}
+
+		var bandRate decimal.Decimal
+		if side == Buy {
+			bandRate = best.Rate.Mul(decimal.New(1, 0).Add(opts.MaxSlippage))
+		} else {
+			bandRate = best.Rate.Mul(decimal.New(1, 0).Sub(opts.MaxSlippage))
+		}
+
+		// use tighter rate
+		if rate.IsZero() || better(opposite, bandRate, rate) {
+			rate = bandRate
+		}
+	}
+
+	return rate
+}
+
+func (s *service) PreviewMarketOrder(ctx context.Context, market string, side Side, value decimal.Decimal, opts MarketOrderOptions) (MarketOrderPreview, error) {
+	if value.LessThanOrEqual(decimal.Zero) {
+		return MarketOrderPreview{}, ErrInvalidValue
+	}
+	if !ValidSide(side) {
+		return MarketOrderPreview{}, ErrInvalidSide
+	}
+	if opts.QuoteValue && side != Buy {
+		return MarketOrderPreview{}, ErrInvalidSide
+	}
+	if !s.validMarket(ctx, market) {
+		return MarketOrderPreview{}, ErrInvalidMarket
+	}
+	err := validMarketOrderOptions(opts)
+	if err != nil {
+		return MarketOrderPreview{}, err
+	}
+
+	var p MarketOrderPreview
+	err = s.execute(ctx, market, func(ctx context.Context, book *orderBook) error {
+		p = book.preview(side, value, opts.QuoteValue, book.worstRate(side, opts), s.amountPrecision(ctx, market), true)
+		return nil
+	})
+	if err != nil {
+		return MarketOrderPreview{}, err
+	}
+
+	return p, nil
+}
+
+// preview walks opposite orders like market order matching,
+// iceberg orders count only their visible value when visibleOnly
+func (b *orderBook) preview(side Side, value decimal.Decimal, quoteValue bool, worstRate decimal.Decimal, amountPrecision int32, visibleOnly bool) MarketOrderPreview {
+	opposite := Buy
+	if side == Buy {
+		opposite = Sell
+	}
+
+	var p MarketOrderPreview
+	p.Remaining = value
+	if best := b.front(opposite); best != nil {
+		p.BestRate = best.Rate
+	}
+
+walk:
+	for _, level := range *b.levels(opposite) {
+		if !worstRate.IsZero() && better(opposite, worstRate, level.rate) {
+			break
+		}
+
+		for _, order := range level.orders {
+			available := order.Remaining
+			if visibleOnly {
+				available = order.display()
+			}
+
+			var amount decimal.Decimal
+			if quoteValue {
+				amount, _ = p.Remaining.QuoRem(level.rate, amountPrecision)
+				amount = decimal.Min(amount, available)
+				if amount.LessThanOrEqual(decimal.Zero) {
+					break walk
+				}
+				p.Remaining = p.Remaining.Sub(amount.Mul(level.rate))
+			} else {
+				amount = decimal.Min(p.Remaining, available)
+				p.Remaining = p.Remaining.Sub(amount)
+			}
+
+			p.Amount = p.Amount.Add(amount)
+			p.Total = p.Total.Add(amount.Mul(level.rate))
+			p.WorstRate = level.rate
+
+			if p.Remaining.LessThanOrEqual(decimal.Zero) {
+				break walk
+			}
+		}
+	}
+
+	if p.Amount.GreaterThan(decimal.Zero) {
+		p.AverageRate = p.Total.Div(p.Amount)
+	}
+
+	return p
+}
+
+// prepareMarketOrder sets market buy order's rate to the worst rate it can fill at,
+// the order reserves funds at this rate
+func (b *orderBook) prepareMarketOrder(order *Order) {
+	if order.Side != Buy || order.QuoteValue {
+		return
+	}
+
+	// amount precision is used only by quote value
+	// reservation covers hidden value of iceberg orders that matching can fill
+	order.Rate = b.preview(order.Side, order.Remaining, false, order.WorstRate, 0, false).WorstRate
+}
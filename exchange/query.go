@@ -0,0 +1,39 @@
+package exchange
+
+import (
+	"context"
+)
+
+// OrderHistoryQuery is the query for order history
+type OrderHistoryQuery struct {
+	UserID   string
+	Market   string
+	Statuses []Status // empty for any status
+	Cursor   string   // cursor from previous page, empty for first page
+	Limit    int      // zero for default limit
+}
+
+// order history page size
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 1000
+)
+
+func (s *service) GetOrder(ctx context.Context, orderID string) (Order, error) {
+	return s.repo.GetOrder(ctx, orderID)
+}
+
+func (s *service) ListOpenOrders(ctx context.Context, filter OrderFilter) ([]Order, error) {
+	return s.repo.ListActiveOrders(ctx, filter)
+}
+
+func (s *service) ListOrderHistory(ctx context.Context, query OrderHistoryQuery) ([]Order, string, error) {
+	if query.Limit < 0 || query.Limit > maxHistoryLimit {
+		return nil, "", ErrInvalidLimit
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultHistoryLimit
+	}
+
+	return s.repo.ListOrderHistory(ctx, query)
+}
@@ -0,0 +1,67 @@
+package exchange
+
+import (
+	"context"
+
+	"github.com/shopspring/decimal"
+)
+
+// MarketRules is market's trading rules, zero value for no rule
+type MarketRules struct {
+	TickSize    decimal.Decimal // rate must be multiple of tick size
+	StepSize    decimal.Decimal // value must be multiple of step size
+	MinValue    decimal.Decimal
+	MaxValue    decimal.Decimal
+	MinNotional decimal.Decimal // minimum rate * value, in buy currency
+}
+
+// RulesGetter is the function that return market's trading rules,
+// it is called on every order placement, so rules can change at runtime
+type RulesGetter func(ctx context.Context, market string) MarketRules
+
+// checkRules validates order's value precision,
+// and order's rates and value with market's trading rules
+func (s *service) checkRules(ctx context.Context, order *Order) error {
+	if !s.validPrecision(ctx, order) {
+		return ErrInvalidPrecision
+	}
+	if s.rules == nil {
+		return nil
+	}
+	rules := s.rules(ctx, order.Market)
+
+	for _, rate := range []decimal.Decimal{order.Rate, order.StopRate} {
+		if !rate.IsZero() && !rules.TickSize.IsZero() && !rate.Mod(rules.TickSize).IsZero() {
+			return ErrInvalidTickSize
+		}
+	}
+
+	// quote value order only has minimum notional
+	if order.QuoteValue {
+		if order.Value.LessThan(rules.MinNotional) {
+			return ErrNotionalTooSmall
+		}
+		return nil
+	}
+
+	if !rules.StepSize.IsZero() && !order.Value.Mod(rules.StepSize).IsZero() {
+		return ErrInvalidStepSize
+	}
+	if order.Value.LessThan(rules.MinValue) {
+		return ErrValueTooSmall
+	}
+	if !rules.MaxValue.IsZero() && order.Value.GreaterThan(rules.MaxValue) {
+		return ErrValueTooLarge
+	}
+
+	// market order's rate is unknown until matched
+	rate := order.Rate
+	if rate.IsZero() {
+		rate = order.StopRate
+	}
+	if !rate.IsZero() && rate.Mul(order.Value).LessThan(rules.MinNotional) {
+		return ErrNotionalTooSmall
+	}
+
+	return nil
+}
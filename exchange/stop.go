@@ -0,0 +1,230 @@
+package exchange
+
+import (
+	"context"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/acoshift/go-services/wallet"
+)
+
+func (s *service) PlaceStopLimitOrder(ctx context.Context, userID string, market string, side Side, stopRate, rate, value decimal.Decimal) (string, error) {
+	if rate.LessThanOrEqual(decimal.Zero) {
+		return "", ErrInvalidRate
+	}
+
+	return s.placeStopOrder(ctx, Order{
+		UserID:    userID,
+		Market:    market,
+		Type:      StopLimit,
+		Side:      side,
+		Rate:      rate,
+		StopRate:  stopRate,
+		Value:     value,
+		Remaining: value,
+		Status:    Active,
+	})
+}
+
+func (s *service) PlaceStopMarketOrder(ctx context.Context, userID string, market string, side Side, stopRate, value decimal.Decimal) (string, error) {
+	return s.placeStopOrder(ctx, Order{
+		UserID:    userID,
+		Market:    market,
+		Type:      StopMarket,
+		Side:      side,
+		StopRate:  stopRate,
+		Value:     value,
+		Remaining: value,
+		Status:    Active,
+	})
+}
+
+// Trail is trailing stop's distance from last trade rate,
+// only one of Offset or Ratio must be set
+type Trail struct {
+	Offset decimal.Decimal // fixed rate distance
+	Ratio  decimal.Decimal // ratio of last trade rate (0.05 for 5%)
+}
+
+func (s *service) PlaceTrailingStopOrder(ctx context.Context, userID string, market string, side Side, trail Trail, value decimal.Decimal) (string, error) {
+	if trail.Offset.LessThan(decimal.Zero) || trail.Ratio.LessThan(decimal.Zero) || trail.Ratio.GreaterThanOrEqual(decimal.New(1, 0)) {
+		return "", ErrInvalidTrail
+	}
+	if trail.Offset.IsZero() == trail.Ratio.IsZero() {
+		return "", ErrInvalidTrail
+	}
+
+	return s.placeStopOrder(ctx, Order{
+		UserID:      userID,
+		Market:      market,
+		Type:        TrailingStop,
+		Side:        side,
+		TrailOffset: trail.Offset,
+		TrailRatio:  trail.Ratio,
+		Value:       value,
+		Remaining:   value,
+		Status:      Active,
+	})
+}
+
+func (s *service) placeStopOrder(ctx context.Context, order Order) (string, error) {
+	if order.Value.LessThanOrEqual(decimal.Zero) {
+		return "", ErrInvalidValue
+	}
+	if order.Type != TrailingStop && order.StopRate.LessThanOrEqual(decimal.Zero) {
+		return "", ErrInvalidStopRate
+	}
+	if !ValidSide(order.Side) {
+		return "", ErrInvalidSide
+	}
+	if !s.validMarket(ctx, order.Market) {
+		return "", ErrInvalidMarket
+	}
+	err := s.checkRules(ctx, &order)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.execute(ctx, order.Market, func(ctx context.Context, book *orderBook) error {
+		if order.Type == TrailingStop {
+			if book.lastRate.IsZero() {
+				return ErrNoLastRate
+			}
+			order.StopRate = order.trailingStopRate(book.lastRate)
+
+			// sell stop rate at or below zero never triggers
+			if order.StopRate.LessThanOrEqual(decimal.Zero) {
+				return ErrInvalidTrail
+			}
+
+			// trailing stop buy order's stop rate only moves down,
+			// the order reserves funds at the initial stop rate
+			if order.Side == Buy {
+				order.Rate = s.reserveRate(ctx, &order, order.StopRate)
+			}
+		}
+
+		return s.runInTx(ctx, book, func(ctx context.Context) error {
+			// stop-market buy order reserves funds at stop rate
+			err := s.addBalance(ctx, order.UserID, s.getCurrency(ctx, order.Market, order.Side), reservedValue(&order).Neg())
+			if err != nil {
+				return err
+			}
+
+			order.ID, err = s.repo.CreateOrder(ctx, order)
+			if err != nil {
+				return err
+			}
+			book.insertStop(&order)
+
+			return nil
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return order.ID, nil
+}
+
+// runTriggeredOrders converts triggered stop orders into limit or market orders
+// and runs matching for them, until no more stop order triggered
+func (s *service) runTriggeredOrders(ctx context.Context, book *orderBook) error {
+	for len(book.triggered) > 0 {
+		order := book.triggered[0]
+		book.triggered = book.triggered[1:]
+
+		// order may be cancelled by its group after triggered
+		current, err := s.repo.GetOrder(ctx, order.ID)
+		if err != nil {
+			return err
+		}
+		if !current.Status.IsOpen() {
+			continue
+		}
+
+		// triggered order cancels the others in its group
+		err = s.cancelGroup(ctx, book, order)
+		if err != nil {
+			return err
+		}
+
+		switch order.Type {
+		case StopLimit:
+			err = s.repo.SetOrderTypeAndRate(ctx, order.ID, Limit, order.Rate)
+			if err != nil {
+				return err
+			}
+
+			_, err = s.matchingLimitOrder(ctx, book, order.ID)
+			if err != nil {
+				return err
+			}
+		case StopMarket, TrailingStop:
+			// move reservation from stop rate to the worst rate market order can fill at
+			stopReserved := reservedValue(order)
+			order.Type = Market
+			book.prepareMarketOrder(order)
+			order.Rate = s.reserveRate(ctx, order, order.Rate)
+
+			err = s.addBalance(ctx, order.UserID, s.getCurrency(ctx, order.Market, order.Side), stopReserved.Sub(reservedValue(order)))
+			if err == wallet.ErrBalanceNotEnough {
+				// can not reserve funds for market order, refund stop reservation
+				err = s.cancelOrder(ctx, book, order.ID)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			err = s.repo.SetOrderTypeAndRate(ctx, order.ID, Market, order.Rate)
+			if err != nil {
+				return err
+			}
+
+			pending, err := s.matchingMarketOrder(ctx, book, order.ID)
+			if err != nil {
+				return err
+			}
+
+			if !pending {
+				err = s.cancelOrder(ctx, book, order.ID)
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			return ErrInvalidType
+		}
+	}
+
+	return nil
+}
+
+// trailStopOrders moves trailing stop orders' stop rate to follow last trade rate
+func (s *service) trailStopOrders(ctx context.Context, book *orderBook, rate decimal.Decimal) error {
+	for _, order := range book.stops {
+		if order.Type != TrailingStop {
+			continue
+		}
+
+		stopRate := order.trailingStopRate(rate)
+		if order.Side == Buy && stopRate.GreaterThanOrEqual(order.StopRate) {
+			continue
+		}
+		if order.Side == Sell && stopRate.LessThanOrEqual(order.StopRate) {
+			continue
+		}
+
+		err := s.repo.SetOrderStopRate(ctx, order.ID, stopRate)
+		if err != nil {
+			return err
+		}
+		order.StopRate = stopRate
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package exchange
+
+import (
+	"context"
+
+	"github.com/shopspring/decimal"
+)
+
+// SelfTradePrevention is how to handle taker order that would match maker order of the same owner
+type SelfTradePrevention int
+
+// SelfTradePrevention values
+const (
+	AllowSelfTrade     SelfTradePrevention = iota
+	CancelNewest                           // cancel taker order
+	CancelOldest                           // cancel maker order, taker continues matching
+	CancelBoth                             // cancel both orders
+	DecrementAndCancel                     // reduce both orders by the smaller remaining, cancel the order that has nothing remaining
+)
+
+// AccountGroupGetter gets user's account group,
+// returns empty string if user not in any group
+type AccountGroupGetter func(ctx context.Context, userID string) string
+
+// sameOwner checks are orders owned by the same user or account group
+func (s *service) sameOwner(ctx context.Context, order, matchOrder *Order) bool {
+	if order.UserID == matchOrder.UserID {
+		return true
+	}
+	if s.accountGroup == nil {
+		return false
+	}
+
+	group := s.accountGroup(ctx, order.UserID)
+	return group != "" && group == s.accountGroup(ctx, matchOrder.UserID)
+}
+
+// ownOrder returns function that checks is order owned by the same user or account group,
+// or nil if self trade is allowed
+func (s *service) ownOrder(ctx context.Context, userID string) func(order *Order) bool {
+	if s.stp == AllowSelfTrade {
+		return nil
+	}
+
+	return func(order *Order) bool {
+		return s.sameOwner(ctx, &Order{UserID: userID}, order)
+	}
+}
+
+// preventSelfTrade handles taker order that would match maker order of the same owner,
+// matching continues while taker order is open
+func (s *service) preventSelfTrade(ctx context.Context, book *orderBook, order, matchOrder *Order) error {
+	switch s.stp {
+	case CancelNewest:
+		return s.cancelTaker(ctx, book, order)
+	case CancelOldest:
+		return s.cancelOrder(ctx, book, matchOrder.ID)
+	case CancelBoth:
+		err := s.cancelOrder(ctx, book, matchOrder.ID)
+		if err != nil {
+			return err
+		}
+		return s.cancelTaker(ctx, book, order)
+	case DecrementAndCancel:
+		amount := decimal.Min(order.Remaining, matchOrder.Remaining)
+		orderAmount := amount
+		if order.QuoteValue {
+			amount, _ = order.Remaining.QuoRem(matchOrder.Rate, s.amountPrecision(ctx, order.Market))
+			amount = decimal.Min(amount, matchOrder.Remaining)
+			orderAmount = amount.Mul(matchOrder.Rate)
+		}
+
+		err := s.decrementOrder(ctx, matchOrder, amount)
+		if err != nil {
+			return err
+		}
+		if matchOrder.Remaining.LessThanOrEqual(decimal.Zero) {
+			err = s.cancelOrder(ctx, book, matchOrder.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = s.decrementOrder(ctx, order, orderAmount)
+		if err != nil {
+			return err
+		}
+		// quote value order cancels the dust that can not buy any amount
+		if order.Remaining.LessThanOrEqual(decimal.Zero) || amount.IsZero() {
+			return s.cancelTaker(ctx, book, order)
+		}
+		return nil
+	default:
+		return ErrInvalidSelfTradePrevention
+	}
+}
+
+// decrementOrder reduces order's value and remaining without trade,
+// and refunds released reservation
+func (s *service) decrementOrder(ctx context.Context, order *Order, value decimal.Decimal) error {
+	if value.IsZero() {
+		return nil
+	}
+
+	reserved := reservedValue(order)
+	order.Value = order.Value.Sub(value)
+	order.Remaining = order.Remaining.Sub(value)
+	order.visible = decimal.Min(order.visible, order.Remaining)
+
+	err := s.repo.SetOrderRateValueAndRemaining(ctx, order.ID, order.Rate, order.Value, order.Remaining, false)
+	if err != nil {
+		return err
+	}
+
+	return s.addBalance(ctx, order.UserID, s.getCurrency(ctx, order.Market, order.Side), reserved.Sub(reservedValue(order)))
+}
+
+// cancelTaker cancels taker order while matching,
+// order's fills are persisted before cancel
+func (s *service) cancelTaker(ctx context.Context, book *orderBook, order *Order) error {
+	err := s.repo.SetOrderStatusRemainingFilledAndStampMatched(ctx, order.ID, order.Status, order.Remaining, order.Filled, order.AverageRate)
+	if err != nil {
+		return err
+	}
+
+	err = s.cancelOrder(ctx, book, order.ID)
+	if err != nil {
+		return err
+	}
+
+	order.Status = Cancelled
+	if order.Filled.GreaterThan(decimal.Zero) {
+		order.Status = PartiallyCancelled
+	}
+	return nil
+}
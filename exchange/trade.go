@@ -0,0 +1,83 @@
+package exchange
+
+import (
+	"context"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Trade is a fill between maker and taker orders
+type Trade struct {
+	ID               string
+	Market           string
+	MakerOrderID     string
+	MakerUserID      string
+	TakerOrderID     string
+	TakerUserID      string
+	TakerSide        Side
+	Rate             decimal.Decimal
+	Amount           decimal.Decimal
+	MakerFee         decimal.Decimal // charged fee, negative for rebate
+	MakerFeeCurrency string          // currency maker receives and pays fee in
+	TakerFee         decimal.Decimal // charged fee, negative for rebate
+	TakerFeeCurrency string          // currency taker receives and pays fee in
+	CreatedAt        time.Time
+}
+
+// TradeHistoryQuery is the query for user's trade history
+type TradeHistoryQuery struct {
+	UserID string
+	Market string // empty for any market
+	Cursor string // cursor from previous page, empty for first page
+	Limit  int    // zero for default limit
+}
+
+// insertTrade records a trade with charged fees and triggers stop orders
+func (s *service) insertTrade(ctx context.Context, book *orderBook, taker, maker *Order, rate, amount, takerFee, makerFee decimal.Decimal) error {
+	_, err := s.repo.InsertTrade(ctx, Trade{
+		Market:           taker.Market,
+		MakerOrderID:     maker.ID,
+		MakerUserID:      maker.UserID,
+		TakerOrderID:     taker.ID,
+		TakerUserID:      taker.UserID,
+		TakerSide:        taker.Side,
+		Rate:             rate,
+		Amount:           amount,
+		MakerFee:         makerFee,
+		MakerFeeCurrency: s.receiveCurrency(ctx, maker),
+		TakerFee:         takerFee,
+		TakerFeeCurrency: s.receiveCurrency(ctx, taker),
+	})
+	if err != nil {
+		return err
+	}
+
+	book.lastRate = rate
+	book.trigger(rate)
+
+	// remaining trailing stop orders follow the trade
+	return s.trailStopOrders(ctx, book, rate)
+}
+
+func (s *service) ListTrades(ctx context.Context, market string, limit int) ([]Trade, error) {
+	if limit < 0 || limit > maxHistoryLimit {
+		return nil, ErrInvalidLimit
+	}
+	if limit == 0 {
+		limit = defaultHistoryLimit
+	}
+
+	return s.repo.ListTrades(ctx, market, limit)
+}
+
+func (s *service) ListUserTrades(ctx context.Context, query TradeHistoryQuery) ([]Trade, string, error) {
+	if query.Limit < 0 || query.Limit > maxHistoryLimit {
+		return nil, "", ErrInvalidLimit
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultHistoryLimit
+	}
+
+	return s.repo.ListUserTrades(ctx, query)
+}
@@ -0,0 +1,40 @@
+package exchange
+
+import (
+	"context"
+)
+
+// TxRunner runs function in a transaction,
+// the transaction must be passed through context to both exchange and wallet repositories,
+// then commits when function returns nil or rolls back when function returns an error
+type TxRunner interface {
+	RunInTx(ctx context.Context, f func(ctx context.Context) error) error
+}
+
+// TxRunnerFunc is an adapter to use function as TxRunner
+type TxRunnerFunc func(ctx context.Context, f func(ctx context.Context) error) error
+
+// RunInTx calls fn(ctx, f)
+func (fn TxRunnerFunc) RunInTx(ctx context.Context, f func(ctx context.Context) error) error {
+	return fn(ctx, f)
+}
+
+// runInTx runs f as a single unit of work on market's book,
+// book state can not roll back, so the book is invalidated when f failed
+func (s *service) runInTx(ctx context.Context, book *orderBook, f func(ctx context.Context) error) error {
+	pending := append([]string(nil), book.pending...)
+
+	var err error
+	if s.tx == nil {
+		err = f(ctx)
+	} else {
+		err = s.tx.RunInTx(ctx, f)
+	}
+	if err != nil {
+		book.invalidate()
+		book.pending = pending
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package exchange
+
+import (
+	"context"
+)
+
+// defaultQueueSize is the default number of pending commands per market
+const defaultQueueSize = 256
+
+// command is a function that runs on market's worker with market's order book
+type command struct {
+	ctx    context.Context
+	f      func(ctx context.Context, book *orderBook) error
+	result chan error
+}
+
+// marketWorker runs all market's commands in a single goroutine,
+// so only one command can read or write market's order book at a time
+type marketWorker struct {
+	market string
+	book   *orderBook
+	queue  chan command
+	done   chan struct{} // closed when worker stopped
+}
+
+func (s *service) run(w *marketWorker) {
+	defer s.workers.Done()
+	defer close(w.done)
+
+	for {
+		select {
+		case <-s.closed:
+			// closed worker only finishes pending matching,
+			// commands waiting in queue return ErrClosed
+			if len(w.book.pending) == 0 {
+				return
+			}
+			s.runPending(w)
+			continue
+		default:
+		}
+
+		if len(w.book.pending) == 0 {
+			select {
+			case <-s.closed:
+			case cmd := <-w.queue:
+				cmd.result <- s.runCommand(w, cmd)
+			}
+			continue
+		}
+
+		// interleave commands with pending matching,
+		// so a large order does not hold the market
+		select {
+		case cmd := <-w.queue:
+			cmd.result <- s.runCommand(w, cmd)
+		default:
+		}
+		s.runPending(w)
+	}
+}
+
+// runPending continues matching the first pending order,
+// the order is cancelled if it can not continue
+func (s *service) runPending(w *marketWorker) {
+	if len(w.book.pending) == 0 {
+		return
+	}
+
+	orderID := w.book.pending[0]
+	w.book.pending = w.book.pending[1:]
+
+	// caller already got the result, the order continues without caller's context
+	ctx := context.Background()
+	err := w.book.load(ctx, s.repo, w.market)
+	if err == nil {
+		err = s.runInTx(ctx, w.book, func(ctx context.Context) error {
+			return s.continueMatching(ctx, w.book, orderID)
+		})
+	}
+	if err == nil {
+		return
+	}
+	s.handleError(err)
+
+	// failed order is no longer pending, cancel it so the remaining funds do not stay reserved
+	err = w.book.load(ctx, s.repo, w.market)
+	if err == nil {
+		err = s.runInTx(ctx, w.book, func(ctx context.Context) error {
+			return s.cancelOrder(ctx, w.book, orderID)
+		})
+	}
+	if err != nil {
+		s.handleError(err)
+	}
+}
+
+// handleError reports asynchronous matching error to error handler
+func (s *service) handleError(err error) {
+	if s.errHandler != nil {
+		s.errHandler(err)
+	}
+}
+
+func (s *service) runCommand(w *marketWorker, cmd command) error {
+	// caller already gone while command waiting in queue
+	err := cmd.ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	err = w.book.load(cmd.ctx, s.repo, w.market)
+	if err != nil {
+		return err
+	}
+
+	return cmd.f(cmd.ctx, w.book)
+}
+
+// getWorker returns market's worker, starts a new one if not exists
+func (s *service) getWorker(market string) (*marketWorker, error) {
+	s.workersMu.Lock()
+	defer s.workersMu.Unlock()
+
+	select {
+	case <-s.closed:
+		return nil, ErrClosed
+	default:
+	}
+
+	w := s.markets[market]
+	if w == nil {
+		w = &marketWorker{
+			market: market,
+			book:   new(orderBook),
+			queue:  make(chan command, s.queueSize),
+			done:   make(chan struct{}),
+		}
+		s.markets[market] = w
+		s.workers.Add(1)
+		go s.run(w)
+	}
+	return w, nil
+}
+
+// execute submits f to market's worker and waits for the result,
+// submit blocks while market's queue is full until context is done
+func (s *service) execute(ctx context.Context, market string, f func(ctx context.Context, book *orderBook) error) error {
+	w, err := s.getWorker(market)
+	if err != nil {
+		return err
+	}
+
+	cmd := command{
+		ctx:    ctx,
+		f:      f,
+		result: make(chan error, 1),
+	}
+
+	select {
+	case w.queue <- cmd:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.closed:
+		return ErrClosed
+	}
+
+	// command can not abort after submitted, wait until worker finishes it
+	select {
+	case err = <-cmd.result:
+		return err
+	case <-w.done:
+	}
+
+	// worker stops only between commands, command may finish before worker stopped
+	select {
+	case err = <-cmd.result:
+		return err
+	default:
+		return ErrClosed
+	}
+}
+
+func (s *service) Close() error {
+	s.workersMu.Lock()
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+	s.workersMu.Unlock()
+
+	s.workers.Wait()
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 var (
 	ErrBalanceNotEnough = errors.New("wallet: balance is not enough")
 	ErrInvalidValue     = errors.New("wallet: invalid value")
+	ErrInvalidPrecision = errors.New("wallet: value exceeds currency precision")
 )
 
 // Wallet is wallet service
@@ -33,13 +34,26 @@ type Repository interface {
 	InsertTx(ctx context.Context, userID string, currency string, value decimal.Decimal) error
 }
 
+// PrecisionGetter is the function that return currency's decimal places
+type PrecisionGetter func(ctx context.Context, currency string) int32
+
 // New creates new wallet service
 func New(repo Repository) Wallet {
-	return &service{repo}
+	return NewWithPrecision(repo, nil)
+}
+
+// NewWithPrecision creates new wallet service
+// that rejects value more precise than currency's precision
+func NewWithPrecision(repo Repository, precision PrecisionGetter) Wallet {
+	return &service{
+		repo:      repo,
+		precision: precision,
+	}
 }
 
 type service struct {
-	repo Repository
+	repo      Repository
+	precision PrecisionGetter // nil for no precision limit
 }
 
 func (s *service) Balance(ctx context.Context, userID string, currency string) (decimal.Decimal, error) {
@@ -52,6 +66,10 @@ func (s *service) Add(ctx context.Context, userID string, currency string, value
 		return nil
 	}
 
+	if s.precision != nil && !value.Equal(value.Truncate(s.precision(ctx, currency))) {
+		return ErrInvalidPrecision
+	}
+
 	// can not debt more than current balance
 	if value.LessThan(decimal.Zero) {
 		b, err := s.repo.GetBalance(ctx, userID, currency)